@@ -0,0 +1,138 @@
+package shoset
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdmissionOptions : connections accepted by the listener of a shoset
+type AdmissionOptions struct {
+	MaxConns         int           // connections accepted at the same time, unlimited when 0
+	MaxConnsPerIP    int           // connections accepted at the same time from an IP, unlimited when 0
+	HandshakeTimeout time.Duration // delay for a peer to introduce itself (link, join or bye) before it is dropped, none when 0
+	Allow            []string      // CIDR of the accepted peers, all when empty
+	Deny             []string      // CIDR of the refused peers, checked before Allow
+}
+
+// DefaultAdmissionOptions : admission of the new shosets
+var DefaultAdmissionOptions = AdmissionOptions{HandshakeTimeout: 10 * time.Second}
+
+// AdmissionStats : connections accepted and refused by the listener
+type AdmissionStats struct {
+	Active            int   // connections accepted and still open
+	Accepted          int64 // connections accepted
+	Denied            int64 // connections refused by the CIDR lists
+	TooMany           int64 // connections refused by MaxConns or MaxConnsPerIP
+	HandshakeTimeouts int64 // connections dropped without handshake
+}
+
+// admission : admission control of the listener
+type admission struct {
+	opts  AdmissionOptions
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	perIP map[string]int
+	stats AdmissionStats
+	m     sync.Mutex
+}
+
+func newAdmission() *admission {
+	a := new(admission)
+	a.opts = DefaultAdmissionOptions
+	a.perIP = make(map[string]int)
+	return a
+}
+
+// SetAdmissionOptions : connections accepted by the listener from now on, the ones already open are kept
+func (c *Shoset) SetAdmissionOptions(opts AdmissionOptions) error {
+	allow, err := parseCIDRs(opts.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := parseCIDRs(opts.Deny)
+	if err != nil {
+		return err
+	}
+	c.admission.m.Lock()
+	defer c.admission.m.Unlock()
+	c.admission.opts = opts
+	c.admission.allow = allow
+	c.admission.deny = deny
+	return nil
+}
+
+// GetAdmissionStats : connections accepted and refused by the listener
+func (c *Shoset) GetAdmissionStats() AdmissionStats {
+	c.admission.m.Lock()
+	defer c.admission.m.Unlock()
+	return c.admission.stats
+}
+
+// setHandshaked : the peer of the connection introduced itself, it is not dropped by the handshake timeout
+func (c *ShosetConn) setHandshaked() { atomic.StoreInt32(&c.handshaked, 1) }
+
+func (c *ShosetConn) isHandshaked() bool { return atomic.LoadInt32(&c.handshaked) == 1 }
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("SetAdmissionOptions : " + err.Error())
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit : count a connection accepted from ip, false when it must be closed ; the handshake timeout is returned
+func (a *admission) admit(ip net.IP) (bool, time.Duration) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if inNetworks(a.deny, ip) || (len(a.allow) > 0 && !inNetworks(a.allow, ip)) {
+		a.stats.Denied++
+		return false, 0
+	}
+	if (a.opts.MaxConns > 0 && a.stats.Active >= a.opts.MaxConns) ||
+		(a.opts.MaxConnsPerIP > 0 && a.perIP[ip.String()] >= a.opts.MaxConnsPerIP) {
+		a.stats.TooMany++
+		return false, 0
+	}
+	a.stats.Active++
+	a.stats.Accepted++
+	a.perIP[ip.String()]++
+	return true, a.opts.HandshakeTimeout
+}
+
+// release : a connection accepted from ip is closed
+func (a *admission) release(ip net.IP) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.stats.Active--
+	if a.perIP[ip.String()]--; a.perIP[ip.String()] <= 0 {
+		delete(a.perIP, ip.String())
+	}
+}
+
+// handshakeTimeout : drop conn if its peer did not introduce itself in time
+func (a *admission) handshakeTimeout(conn *ShosetConn) {
+	if conn.isHandshaked() {
+		return
+	}
+	a.m.Lock()
+	a.stats.HandshakeTimeouts++
+	a.m.Unlock()
+	conn.socket.Close() // ends runInConn
+}
@@ -0,0 +1,66 @@
+package shoset_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+)
+
+// TestAdmission : the listener refuses the connections over its limits or from denied networks,
+// and drops the ones which do not complete their handshake
+func TestAdmission(t *testing.T) {
+	cl, aga := newShosets(t)
+	if err := cl.SetAdmissionOptions(shoset.AdmissionOptions{Deny: []string{"localhost"}}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	cl.SetAdmissionOptions(shoset.AdmissionOptions{MaxConnsPerIP: 1, HandshakeTimeout: 300 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond) // listening
+	waitStats := func(ok func(shoset.AdmissionStats) bool) shoset.AdmissionStats {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stats := cl.GetAdmissionStats()
+			if ok(stats) || time.Now().After(deadline) {
+				return stats
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 2; i++ { // silent peers
+		conn, err := net.Dial("tcp", cl.GetBindAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	stats := waitStats(func(s shoset.AdmissionStats) bool { return s.TooMany == 1 })
+	if stats.Accepted != 1 || stats.TooMany != 1 || stats.Active != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	stats = waitStats(func(s shoset.AdmissionStats) bool { return s.Active == 0 })
+	if stats.HandshakeTimeouts != 1 || stats.Active != 0 {
+		t.Errorf("unexpected stats after the handshake timeout %+v", stats)
+	}
+
+	cl.SetAdmissionOptions(shoset.AdmissionOptions{Deny: []string{"127.0.0.0/8", "::1/128"}})
+	conn, err := net.Dial("tcp", cl.GetBindAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if stats = waitStats(func(s shoset.AdmissionStats) bool { return s.Denied == 1 }); stats.Denied != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	cl.SetAdmissionOptions(shoset.AdmissionOptions{
+		Allow:            []string{"127.0.0.0/8", "::1/128"},
+		HandshakeTimeout: 300 * time.Millisecond,
+	})
+	link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond)
+	if stats = cl.GetAdmissionStats(); stats.Active != 1 || stats.HandshakeTimeouts != 1 {
+		t.Errorf("identified peer dropped %+v", stats)
+	}
+}
@@ -7,6 +7,28 @@ import (
 	"github.com/ditrit/shoset/msg"
 )
 
+// CommandHandler : MessageHandlers of the "cmd" messages
+type CommandHandler struct{}
+
+// Get :
+func (CommandHandler) Get(c *ShosetConn) (msg.Message, error) { return GetCommand(c) }
+
+// Handle :
+func (CommandHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleCommand(c, message)
+}
+
+// SendConn :
+func (CommandHandler) SendConn(c *ShosetConn, cmd msg.Message) error { return c.WriteMessage(cmd) }
+
+// Send :
+func (CommandHandler) Send(c *Shoset, cmd msg.Message) { SendCommand(c, cmd) }
+
+// Wait :
+func (CommandHandler) Wait(c *Shoset, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	return WaitCommand(c, replies, args, timeout)
+}
+
 // GetCommand :
 func GetCommand(c *ShosetConn) (msg.Message, error) {
 	var cmd msg.Command
@@ -17,18 +39,15 @@ func GetCommand(c *ShosetConn) (msg.Message, error) {
 // HandleCommand :
 func HandleCommand(c *ShosetConn, message msg.Message) error {
 	cmd := message.(msg.Command)
-	c.GetCh().Queue["cmd"].Push(cmd, c.GetRemoteShosetType(), c.GetLocalAddress())
-	return nil
+	return c.GetCh().GetQueue("cmd").Put(cmd, c.GetRemoteShosetType(), c.GetLocalAddress())
 }
 
 // SendCommand :
 func SendCommand(c *Shoset, cmd msg.Message) {
 	fmt.Print("Sending Command.\n")
-	c.ConnsByName.IterateAll(
-		func(key string, conn *ShosetConn) {
-			conn.SendMessage(cmd)
-		},
-	)
+	for _, conn := range c.ConnsByName.GetAll() {
+		conn.SendMessage(cmd)
+	}
 }
 
 // WaitCommand :
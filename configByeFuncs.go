@@ -6,6 +6,19 @@ import (
 	"github.com/ditrit/shoset/msg"
 )
 
+// ConfigByeHandler : MessageHandlers of the "cfgbye" messages
+type ConfigByeHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (ConfigByeHandler) Get(c *ShosetConn) (msg.Message, error) { return GetConfigBye(c) }
+
+// Handle :
+func (ConfigByeHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleConfigBye(c, message)
+}
+
 // GetConfigBye :
 func GetConfigBye(c *ShosetConn) (msg.Message, error) {
 	var cfg msg.ConfigProtocol
@@ -23,6 +36,7 @@ func HandleConfigBye(c *ShosetConn, message msg.Message) error {
 	switch cfg.GetCommandName() {
 	case "bye":
 		if dir == "in" {
+			c.setHandshaked()
 			cfgNewDelete := msg.NewCfg(remoteAddress, ch.GetLogicalName(), ch.GetShosetType(), "delete")
 			ch.ConnsByName.IterateAll(
 				func(address string, bro *ShosetConn) {
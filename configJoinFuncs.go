@@ -7,6 +7,19 @@ import (
 	"github.com/ditrit/shoset/msg"
 )
 
+// ConfigJoinHandler : MessageHandlers of the "cfgjoin" messages
+type ConfigJoinHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (ConfigJoinHandler) Get(c *ShosetConn) (msg.Message, error) { return GetConfigJoin(c) }
+
+// Handle :
+func (ConfigJoinHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleConfigJoin(c, message)
+}
+
 // GetConfigJoin :
 func GetConfigJoin(c *ShosetConn) (msg.Message, error) {
 	var cfg msg.ConfigProtocol
@@ -26,6 +39,7 @@ func HandleConfigJoin(c *ShosetConn, message msg.Message) error {
 		if dir == "in" { // a socket wants to join this one
 			if connsJoin := c.ch.ConnsByName.Get(c.ch.GetLogicalName()); connsJoin != nil { //already joined
 				if connsJoin.Get(remoteAddress) != nil {
+					c.setHandshaked()
 					return nil
 				}
 			}
@@ -34,11 +48,13 @@ func HandleConfigJoin(c *ShosetConn, message msg.Message) error {
 				c.SetRemoteAddress(remoteAddress)
 				c.SetRemoteLogicalName(cfg.GetLogicalName())
 				c.SetRemoteShosetType(cfg.GetShosetType())
+				c.negotiate(cfg)
 				ch.ConnsByName.Set(ch.GetLogicalName(), remoteAddress, "join", ch.GetShosetType(),  c) // set conn in this socket
 				// ch.LnamesByProtocol.Set("join", c.GetRemoteLogicalName())
 				// ch.LnamesByType.Set(c.ch.GetShosetType(), c.GetRemoteLogicalName())
 
 				configOk := msg.NewCfg(remoteAddress, ch.GetLogicalName(), ch.GetShosetType(), "aknowledge_join")
+				ch.offerWireOptions(configOk)
 				c.SendMessage(configOk)
 			} else {
 				c.SetIsValid(false)
@@ -61,6 +77,7 @@ func HandleConfigJoin(c *ShosetConn, message msg.Message) error {
 	case "aknowledge_join":
 		c.SetRemoteLogicalName(cfg.GetLogicalName())
 		c.SetRemoteShosetType(cfg.GetShosetType())
+		c.negotiate(cfg)
 		ch.ConnsByName.Set(ch.GetLogicalName(), c.GetRemoteAddress(), "join", ch.GetShosetType(), c) // set conns in the other socket
 		// c.ch.LnamesByProtocol.Set("join", c.GetRemoteLogicalName())
 		// c.ch.LnamesByType.Set(c.ch.GetShosetType(), c.GetRemoteLogicalName())
@@ -6,6 +6,19 @@ import (
 	"github.com/ditrit/shoset/msg"
 )
 
+// ConfigLinkHandler : MessageHandlers of the "cfglink" messages
+type ConfigLinkHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (ConfigLinkHandler) Get(c *ShosetConn) (msg.Message, error) { return GetConfigLink(c) }
+
+// Handle :
+func (ConfigLinkHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleConfigLink(c, message)
+}
+
 // GetConfigLink :
 func GetConfigLink(c *ShosetConn) (msg.Message, error) {
 	var cfg msg.ConfigProtocol
@@ -24,6 +37,7 @@ func HandleConfigLink(c *ShosetConn, message msg.Message) error {
 		if dir == "in" { // a socket wants to link to this one
 			if connsLink := c.ch.ConnsByName.Get(c.ch.GetLogicalName()); connsLink != nil { //already linked
 				if connsLink.Get(remoteAddress) != nil {
+					c.setHandshaked()
 					return nil
 				}
 			}
@@ -31,6 +45,7 @@ func HandleConfigLink(c *ShosetConn, message msg.Message) error {
 			c.SetRemoteAddress(remoteAddress)
 			c.SetRemoteLogicalName(cfg.GetLogicalName()) // avoid tcp port name
 			c.SetRemoteShosetType(cfg.GetShosetType())
+			c.negotiate(cfg)
 			c.ch.ConnsByName.Set(cfg.GetLogicalName(), remoteAddress, "link", cfg.GetShosetType(), c) // set conn in this socket
 			// c.ch.LnamesByProtocol.Set("link", c.GetRemoteLogicalName())
 			// c.ch.LnamesByType.Set(c.ch.GetShosetType(), c.GetRemoteLogicalName())
@@ -48,6 +63,7 @@ func HandleConfigLink(c *ShosetConn, message msg.Message) error {
 			}
 
 			brothers := msg.NewCfgBrothers(localBrothersArray, remoteBrothersArray, c.ch.GetLogicalName(), "brothers", c.ch.GetShosetType())
+			c.ch.offerWireOptions(brothers)
 			remoteBrothers.Iterate(
 				func(address string, remoteBro *ShosetConn) {
 					remoteBro.SendMessage(brothers) //send config to others
@@ -59,6 +75,7 @@ func HandleConfigLink(c *ShosetConn, message msg.Message) error {
 		if dir == "out" { // this socket wants to link to another
 			c.SetRemoteLogicalName(cfg.GetLogicalName())
 			c.SetRemoteShosetType(cfg.GetShosetType())
+			c.negotiate(cfg)
 			c.ch.ConnsByName.Set(cfg.GetLogicalName(), c.GetRemoteAddress(), "link", cfg.GetShosetType(), c) // set conns in the other socket
 			// c.ch.LnamesByProtocol.Set("link", c.GetRemoteLogicalName())
 			// c.ch.LnamesByType.Set(c.ch.GetShosetType(), c.GetRemoteLogicalName())
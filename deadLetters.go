@@ -0,0 +1,164 @@
+package shoset
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// DeadLetterOptions : dead-letter queue of a shoset
+type DeadLetterOptions struct {
+	Retention time.Duration    // time the dead letters are kept
+	Queue     msg.QueueOptions // capacity of the dead-letter queue
+}
+
+// DefaultDeadLetterOptions : dead-letter queue of the new shosets
+var DefaultDeadLetterOptions = DeadLetterOptions{Retention: 24 * time.Hour, Queue: msg.QueueOptions{MaxCount: 10000}}
+
+// GetDeadLetters : queue of the msg.DeadLetter of the messages which could not be delivered,
+// browsable with msg.NewIterator
+func (c *Shoset) GetDeadLetters() *msg.Queue { return c.deadLetters }
+
+// SetDeadLetterOptions : retention of the next dead letters and capacity of the dead-letter queue
+func (c *Shoset) SetDeadLetterOptions(opts DeadLetterOptions) error {
+	if opts.Retention <= 0 {
+		return errors.New("SetDeadLetterOptions : the retention must be positive")
+	}
+	atomic.StoreInt64(&c.deadLetterRetention, int64(opts.Retention))
+	c.deadLetters.SetOptions(opts.Queue)
+	return nil
+}
+
+// GetDeadLetterOptions : retention of the dead letters and capacity of the dead-letter queue
+func (c *Shoset) GetDeadLetterOptions() DeadLetterOptions {
+	return DeadLetterOptions{Retention: c.retention(), Queue: c.deadLetters.GetOptions()}
+}
+
+// retention : time the next dead letters are kept
+func (c *Shoset) retention() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.deadLetterRetention))
+}
+
+// deadLetter : put an undeliverable message in the dead-letter queue
+func (c *Shoset) deadLetter(conn *ShosetConn, m msg.Message, reason string, err error, receivedAt time.Time) {
+	d := msg.NewDeadLetter(m, reason, err, c.retention())
+	d.ReceivedAt = receivedAt.UnixNano()
+	remoteShosetType := ""
+	if conn != nil {
+		d.RemoteAddress = conn.GetRemoteAddress()
+		d.RemoteLogicalName = conn.GetRemoteLogicalName()
+		d.RemoteShosetType = conn.GetRemoteShosetType()
+		remoteShosetType = conn.GetRemoteShosetType()
+	}
+	c.deadLetters.Put(*d, remoteShosetType, d.RemoteAddress)
+}
+
+// dispatch : run the inbound interceptors and the handler of a received message,
+// the message is dead-lettered when they fail. A message sent with QoSAtLeastOnce is
+// acknowledged once handled, and not handled again when it is received again ; as its sender
+// sends it again, it is dead-lettered only when the attempt told by meta is the last one.
+func (c *Shoset) dispatch(conn *ShosetConn, h Handler, m msg.Message, meta msg.FrameMeta, receivedAt time.Time) {
+	atLeastOnce := m.GetQoS() >= msg.QoSAtLeastOnce
+	if atLeastOnce {
+		if handle, handled := c.dedup.begin(m.GetUUID(), c.GetDeliveryOptions().DedupWindow); !handle {
+			if handled { // the acknowledgement was lost
+				conn.WriteMessage(*msg.NewAck(m.GetUUID()))
+			}
+			return
+		}
+	}
+	err := c.inboundHandler(h)(conn, m)
+	if atLeastOnce {
+		c.dedup.end(m.GetUUID(), err == nil)
+		if err == nil {
+			conn.WriteMessage(*msg.NewAck(m.GetUUID()))
+		}
+	}
+	if err != nil && (!atLeastOnce || meta.LastAttempt()) {
+		c.deadLetter(conn, m, msg.DeadLetterHandlerFailed, err, receivedAt)
+	}
+}
+
+// drop : dead-letter a received message dropped before its handler ; a message sent with
+// QoSAtLeastOnce is acknowledged again when it was already handled, and otherwise dead-lettered
+// only when the attempt told by meta is the last one
+func (c *Shoset) drop(conn *ShosetConn, m msg.Message, meta msg.FrameMeta, reason string, err error, receivedAt time.Time) {
+	if m.GetQoS() >= msg.QoSAtLeastOnce {
+		if c.dedup.handled(m.GetUUID()) { // the acknowledgement was lost
+			conn.WriteMessage(*msg.NewAck(m.GetUUID()))
+			return
+		}
+		if !meta.LastAttempt() {
+			return
+		}
+	}
+	c.deadLetter(conn, m, reason, err, receivedAt)
+}
+
+// watchExpiry : dead-letter the messages expiring in the queue of a type without being read by an iterator
+func (c *Shoset) watchExpiry(queue *msg.Queue) {
+	queue.OnExpire(func(cell *msg.Cell) {
+		if cell.WasRead() {
+			return
+		}
+		d := msg.NewDeadLetter(cell.GetMessage(), msg.DeadLetterExpired, nil, c.retention())
+		d.ReceivedAt = cell.GetQueuedAt().UnixNano()
+		d.RemoteAddress = cell.RemoteAddress
+		d.RemoteShosetType = cell.RemoteShosetType
+		c.deadLetters.Put(*d, cell.RemoteShosetType, cell.RemoteAddress)
+	})
+}
+
+// Reinject : deliver a dead letter again and remove it from the dead-letter queue. An expired
+// message is put back in its queue, the others are handled again as if received again from
+// their source connection, which must still be open.
+func (c *Shoset) Reinject(key string) error {
+	cell := c.deadLetters.Get(key)
+	if cell == nil {
+		return errors.New("Reinject : no dead letter " + key)
+	}
+	d := cell.GetMessage().(msg.DeadLetter)
+	m := d.GetMessage()
+	if _, undecoded := m.(msg.Unknown); undecoded {
+		return errors.New("Reinject : message of dead letter " + key + " was not decoded")
+	}
+	handlers, ok := c.getHandlers(m.GetMsgType())
+	if !ok {
+		return errors.New("Reinject : no handlers for message type " + m.GetMsgType())
+	}
+
+	var err error
+	if d.GetReason() == msg.DeadLetterExpired {
+		queue := c.GetQueue(m.GetMsgType())
+		if queue == nil {
+			return errors.New("Reinject : no queue for message type " + m.GetMsgType())
+		}
+		err = queue.Put(m, d.RemoteShosetType, d.RemoteAddress)
+	} else {
+		conn := c.connByAddress(d.RemoteAddress)
+		if conn == nil {
+			return errors.New("Reinject : source connection " + d.RemoteAddress + " of dead letter " + key + " is closed")
+		}
+		err = c.inboundHandler(handlers.Handle)(conn, m)
+	}
+	if err != nil {
+		return err
+	}
+	c.deadLetters.Remove(key)
+	return nil
+}
+
+// connByAddress : connection to a remote address, nil if there is none
+func (c *Shoset) connByAddress(address string) *ShosetConn {
+	var found *ShosetConn
+	c.ConnsByName.IterateAll(
+		func(key string, conn *ShosetConn) {
+			if conn.GetRemoteAddress() == address {
+				found = conn
+			}
+		},
+	)
+	return found
+}
@@ -0,0 +1,141 @@
+package shoset_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestDeadLetterExpired : a message expiring unread is dead-lettered and can be put back in its queue
+func TestDeadLetterExpired(t *testing.T) {
+	s := shoset.NewShoset("test", "cl")
+	dead := msg.NewIterator(s.GetDeadLetters())
+
+	read := msg.NewEventClassic("topic", "event", "read")
+	read.Timeout = 100
+	s.GetQueue("evt").Put(*read, "aga", "remote")
+	msg.NewIterator(s.GetQueue("evt")).Get()
+	unread := msg.NewEventClassic("topic", "event", "unread")
+	unread.Timeout = 100
+	s.GetQueue("evt").Put(*unread, "aga", "remote")
+
+	cell, d := waitDeadLetter(t, dead)
+	if d.GetReason() != msg.DeadLetterExpired || d.GetMessage().GetUUID() != unread.GetUUID() || d.RemoteAddress != "remote" {
+		t.Fatalf("unexpected dead letter %+v", d)
+	}
+	if d.ReceivedAt == 0 || d.FailedAt < d.ReceivedAt {
+		t.Errorf("bad timestamps %d, %d", d.ReceivedAt, d.FailedAt)
+	}
+	if err := s.Reinject(cell.GetMessage().GetUUID()); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetQueue("evt").Get(unread.GetUUID()) == nil {
+		t.Error("message not put back in its queue")
+	}
+	if !s.GetDeadLetters().IsEmpty() {
+		t.Error("reinjected message still in the dead-letter queue")
+	}
+}
+
+// TestDeadLetterHandlerFailed : a message whose handler fails is dead-lettered with its source connection
+func TestDeadLetterHandlerFailed(t *testing.T) {
+	cl, aga := newShosets(t)
+	failures := 1
+	handled := make(chan msg.Message, 1)
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, m msg.Message) error {
+			if failures > 0 {
+				failures--
+				return errors.New("failure")
+			}
+			handled <- m
+			return nil
+		},
+	})
+	dead := msg.NewIterator(cl.GetDeadLetters())
+
+	conn := link(t, aga, cl)
+	sent := msg.NewEventClassic("topic", "event", "payload")
+	conn.SendMessage(*sent)
+	conn.SendMessage(newerMessage{*msg.NewEventClassic("topic", "event", "newer")})
+
+	cell, d := waitDeadLetter(t, dead)
+	if d.GetReason() != msg.DeadLetterHandlerFailed || d.Error != "failure" || d.RemoteShosetType != "aga" {
+		t.Fatalf("unexpected dead letter %+v", d)
+	}
+	if err := cl.Reinject(cell.GetMessage().GetUUID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-handled:
+		if m.GetUUID() != sent.GetUUID() {
+			t.Errorf("unexpected message reinjected %s", m.GetUUID())
+		}
+	case <-time.After(time.Second):
+		t.Error("message not reinjected")
+	}
+
+	_, d = waitDeadLetter(t, dead)
+	if d.GetReason() != msg.DeadLetterNoRoute || d.GetMessage().GetMsgType() != "newer" {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+}
+
+// TestDeadLetterAtLeastOnce : a message sent again after its handler failed is dead-lettered once, by its last attempt
+func TestDeadLetterAtLeastOnce(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DeliveryOptions{AckTimeout: 300 * time.Millisecond, MaxAttempts: 3, DedupWindow: time.Minute}
+	aga.SetDeliveryOptions(opts)
+	opts.MaxAttempts = 10 // the attempts of the sender prevail
+	cl.SetDeliveryOptions(opts)
+	attempts := make(chan struct{}, 10)
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, m msg.Message) error {
+			attempts <- struct{}{}
+			return errors.New("failure")
+		},
+	})
+	dead := msg.NewIterator(cl.GetDeadLetters())
+	undelivered := msg.NewIterator(aga.GetDeadLetters())
+
+	conn := link(t, aga, cl)
+	evt := msg.NewEventClassic("topic", "event", "payload")
+	evt.QoS = msg.QoSAtLeastOnce
+	conn.SendMessage(*evt)
+
+	if _, d := waitDeadLetter(t, undelivered); d.GetReason() != msg.DeadLetterUndelivered {
+		t.Errorf("unexpected dead letter of the sender %+v", d)
+	}
+	if _, d := waitDeadLetter(t, dead); d.GetReason() != msg.DeadLetterHandlerFailed {
+		t.Errorf("unexpected dead letter of the receiver %+v", d)
+	}
+	if cell := dead.Get(); cell != nil {
+		t.Errorf("attempt dead-lettered before the last one : %+v", cell.GetMessage())
+	}
+	if len(attempts) != 3 {
+		t.Errorf("message handled %d times", len(attempts))
+	}
+}
+
+// TestDeadLetterOptions : each shoset has its own dead-letter options
+func TestDeadLetterOptions(t *testing.T) {
+	s, other := shoset.NewShoset("test", "cl"), shoset.NewShoset("other", "cl")
+	if err := s.SetDeadLetterOptions(shoset.DeadLetterOptions{}); err == nil {
+		t.Error("options without retention accepted")
+	}
+	opts := shoset.DeadLetterOptions{Retention: time.Hour, Queue: msg.QueueOptions{MaxCount: 10}}
+	if err := s.SetDeadLetterOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetDeadLetterOptions() != opts || s.GetDeadLetters().GetOptions() != opts.Queue {
+		t.Errorf("unexpected options %+v", s.GetDeadLetterOptions())
+	}
+	if other.GetDeadLetterOptions() != shoset.DefaultDeadLetterOptions {
+		t.Error("options of another shoset changed")
+	}
+}
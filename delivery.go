@@ -0,0 +1,339 @@
+package shoset
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// DeliveryOptions : delivery of the messages sent with msg.QoSAtLeastOnce
+type DeliveryOptions struct {
+	AckTimeout  time.Duration // delay before sending again a message not acknowledged
+	MaxAttempts int           // sendings of a message before it is dead-lettered
+	DedupWindow time.Duration // time the UUIDs of the handled messages are remembered
+}
+
+// DefaultDeliveryOptions : delivery of the new shosets
+var DefaultDeliveryOptions = DeliveryOptions{AckTimeout: 5 * time.Second, MaxAttempts: 10, DedupWindow: 10 * time.Minute}
+
+// outbox : messages sent to a peer with QoSAtLeastOnce and not acknowledged yet, whatever the
+// connection they were sent on
+type outbox struct {
+	all     *outboxes // outboxes of the shoset, holding the delivery options
+	pending map[string]*pendingMessage
+	seq     uint64
+	conn    *ShosetConn // last connection to the peer, the messages are sent again on it
+	running bool        // retransmission goroutine
+	m       sync.Mutex
+}
+
+// pendingMessage : message waiting for its acknowledgement
+type pendingMessage struct {
+	message  msg.Message
+	seq      uint64 // order of the first sending
+	sentAt   time.Time
+	attempts int
+}
+
+func newOutbox(all *outboxes) *outbox {
+	o := new(outbox)
+	o.all = all
+	o.pending = make(map[string]*pendingMessage)
+	return o
+}
+
+// outboxes : outboxes of a shoset by peer, see ShosetConn.peer
+type outboxes struct {
+	byPeer map[string]*outbox
+	opts   DeliveryOptions
+	m      sync.Mutex
+}
+
+func newOutboxes() *outboxes {
+	o := new(outboxes)
+	o.byPeer = make(map[string]*outbox)
+	o.opts = DefaultDeliveryOptions
+	return o
+}
+
+// options : delivery options of the shoset
+func (o *outboxes) options() DeliveryOptions {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.opts
+}
+
+// SetDeliveryOptions : delivery of the messages sent and received from now on with QoSAtLeastOnce,
+// the messages already waiting for their acknowledgement included
+func (c *Shoset) SetDeliveryOptions(opts DeliveryOptions) error {
+	if opts.AckTimeout <= 0 || opts.MaxAttempts <= 0 {
+		return errors.New("SetDeliveryOptions : the ack timeout and the attempts must be positive")
+	}
+	c.outboxes.m.Lock()
+	defer c.outboxes.m.Unlock()
+	c.outboxes.opts = opts
+	return nil
+}
+
+// GetDeliveryOptions : delivery of the messages sent with QoSAtLeastOnce
+func (c *Shoset) GetDeliveryOptions() DeliveryOptions {
+	return c.outboxes.options()
+}
+
+// outboxOf : outbox of the peer of a connection ; the one kept by address before the peer
+// was known is merged into it
+func (c *Shoset) outboxOf(conn *ShosetConn) *outbox {
+	peer, address := conn.peer(), conn.GetRemoteAddress()
+	c.outboxes.m.Lock()
+	o := c.outboxes.byPeer[peer]
+	old := c.outboxes.byPeer[address]
+	if peer != address && old != nil {
+		delete(c.outboxes.byPeer, address)
+	} else {
+		old = nil
+	}
+	if o == nil {
+		o, old = old, nil
+	}
+	if o == nil {
+		o = newOutbox(c.outboxes)
+	}
+	c.outboxes.byPeer[peer] = o
+	c.outboxes.m.Unlock()
+	if old != nil {
+		o.merge(old)
+	}
+	return o
+}
+
+// add : keep a message sent on conn until it is acknowledged
+func (o *outbox) add(m msg.Message, conn *ShosetConn) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.conn = conn
+	if _, ok := o.pending[m.GetUUID()]; ok { // sent again
+		return
+	}
+	o.seq++
+	o.pending[m.GetUUID()] = &pendingMessage{message: m, seq: o.seq, sentAt: time.Now(), attempts: 1}
+	o.start()
+}
+
+// merge : take the pending messages of another outbox of the peer
+func (o *outbox) merge(old *outbox) {
+	old.m.Lock()
+	pending, conn := old.pending, old.conn
+	old.pending = make(map[string]*pendingMessage)
+	old.m.Unlock()
+	o.m.Lock()
+	defer o.m.Unlock()
+	if o.conn == nil {
+		o.conn = conn
+	}
+	for uuid, p := range pending {
+		if _, ok := o.pending[uuid]; !ok {
+			o.pending[uuid] = p
+		}
+	}
+	if len(o.pending) > 0 {
+		o.start()
+	}
+}
+
+// start : start the retransmission goroutine if it is not running (outbox lock held)
+func (o *outbox) start() {
+	if !o.running {
+		o.running = true
+		go o.runRetransmit()
+	}
+}
+
+// ack : forget an acknowledged message
+func (o *outbox) ack(uuid string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	delete(o.pending, uuid)
+}
+
+// attempt : sendings of a pending message, 0 when it is not pending
+func (o *outbox) attempt(uuid string) int {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if p, ok := o.pending[uuid]; ok {
+		return p.attempts
+	}
+	return 0
+}
+
+// frameMeta : meta of the frame of a message, with its attempt when it is sent with QoSAtLeastOnce
+// for the receiver to dead-letter it only when its sender gives up
+func (c *ShosetConn) frameMeta(m msg.Message, meta msg.FrameMeta) msg.FrameMeta {
+	if m.GetQoS() >= msg.QoSAtLeastOnce {
+		meta.Attempt = c.ch.outboxOf(c).attempt(m.GetUUID())
+		meta.MaxAttempts = c.ch.GetDeliveryOptions().MaxAttempts
+	}
+	return meta
+}
+
+// expedite : send again every pending message at once on conn, after a reconnection
+func (o *outbox) expedite(conn *ShosetConn) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.conn = conn
+	for _, p := range o.pending {
+		p.sentAt = time.Time{}
+	}
+}
+
+// due : messages to send again, in their sending order, the messages given up and the connection
+// to send them on ; false when the outbox is empty and the retransmission goroutine stops
+func (o *outbox) due(now time.Time, opts DeliveryOptions) ([]msg.Message, []msg.Message, *ShosetConn, bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if len(o.pending) == 0 {
+		o.running = false
+		return nil, nil, nil, false
+	}
+	var late []*pendingMessage
+	var failed []msg.Message
+	for uuid, p := range o.pending {
+		if now.Sub(p.sentAt) < opts.AckTimeout {
+			continue
+		}
+		if p.attempts >= opts.MaxAttempts {
+			delete(o.pending, uuid)
+			failed = append(failed, p.message)
+			continue
+		}
+		p.attempts++
+		p.sentAt = now
+		late = append(late, p)
+	}
+	sort.Slice(late, func(i, j int) bool { return late[i].seq < late[j].seq })
+	resend := make([]msg.Message, len(late))
+	for i, p := range late {
+		resend[i] = p.message
+	}
+	return resend, failed, o.conn, true
+}
+
+// GetPendingCount : number of messages sent with QoSAtLeastOnce to the peer of the connection
+// and not acknowledged yet
+func (c *ShosetConn) GetPendingCount() int {
+	o := c.ch.outboxOf(c)
+	o.m.Lock()
+	defer o.m.Unlock()
+	return len(o.pending)
+}
+
+// runRetransmit : send again the messages of the outbox until they are acknowledged
+func (o *outbox) runRetransmit() {
+	for {
+		opts := o.all.options()
+		period := opts.AckTimeout / 4
+		if period < 10*time.Millisecond {
+			period = 10 * time.Millisecond
+		}
+		time.Sleep(period)
+		resend, failed, conn, ok := o.due(time.Now(), opts)
+		if !ok {
+			return
+		}
+		for _, m := range resend {
+			conn.WriteMessage(m)
+		}
+		for _, m := range failed {
+			conn.ch.deadLetter(conn, m, msg.DeadLetterUndelivered, errors.New("not acknowledged by the peer"), time.Now())
+		}
+	}
+}
+
+// dedup : UUIDs of the messages sent with QoSAtLeastOnce being handled or handled
+type dedup struct {
+	states     map[string]*dedupState
+	lastPurged time.Time
+	m          sync.Mutex
+}
+
+type dedupState struct {
+	done     bool
+	handling bool
+	at       time.Time
+}
+
+func newDedup() *dedup {
+	d := new(dedup)
+	d.states = make(map[string]*dedupState)
+	d.lastPurged = time.Now()
+	return d
+}
+
+// begin : true when the message must be handled, otherwise whether it was already handled ;
+// the messages handled more than window ago are forgotten
+func (d *dedup) begin(uuid string, window time.Duration) (bool, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastPurged) > window/10 {
+		for key, state := range d.states {
+			if now.Sub(state.at) > window {
+				delete(d.states, key)
+			}
+		}
+		d.lastPurged = now
+	}
+	state, ok := d.states[uuid]
+	if ok && (state.done || state.handling) {
+		return false, state.done
+	}
+	if !ok {
+		state = new(dedupState)
+		d.states[uuid] = state
+	}
+	state.handling = true
+	state.at = now
+	return true, false
+}
+
+// end : the message was handled, or is handled again when it is received again after its handler failed
+func (d *dedup) end(uuid string, handled bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	state := d.states[uuid]
+	if state == nil { // purged meanwhile
+		state = new(dedupState)
+		d.states[uuid] = state
+	}
+	state.handling = false
+	state.done = handled
+	state.at = time.Now()
+}
+
+// handled : the message was handled and not forgotten yet
+func (d *dedup) handled(uuid string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	state, ok := d.states[uuid]
+	return ok && state.done
+}
+
+// AckHandler : MessageHandlers of the "ack" messages
+type AckHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (AckHandler) Get(c *ShosetConn) (msg.Message, error) {
+	var ack msg.Ack
+	err := c.ReadMessage(&ack)
+	return ack, err
+}
+
+// Handle :
+func (AckHandler) Handle(c *ShosetConn, message msg.Message) error {
+	c.ch.outboxOf(c).ack(message.(msg.Ack).GetAckedUUID())
+	return nil
+}
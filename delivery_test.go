@@ -0,0 +1,126 @@
+package shoset_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestAtLeastOnce : a message whose handler failed is sent again until it is acknowledged, and handled once
+func TestAtLeastOnce(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultDeliveryOptions
+	opts.AckTimeout = 300 * time.Millisecond
+	aga.SetDeliveryOptions(opts)
+	var m sync.Mutex
+	attempts, handled := 0, 0
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			m.Lock()
+			defer m.Unlock()
+			attempts++
+			if attempts == 1 {
+				return errors.New("failure")
+			}
+			handled++
+			return nil
+		},
+	})
+
+	conn := link(t, aga, cl)
+	evt := msg.NewEventClassic("topic", "event", "payload")
+	evt.QoS = msg.QoSAtLeastOnce
+	conn.SendMessage(*evt)
+	conn.SendMessage(*evt) // duplicate
+
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.GetPendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if conn.GetPendingCount() > 0 {
+		t.Fatal("message never acknowledged")
+	}
+	time.Sleep(2 * opts.AckTimeout) // no more retransmission
+	m.Lock()
+	defer m.Unlock()
+	if handled != 1 {
+		t.Errorf("message handled %d times", handled)
+	}
+}
+
+// TestAtLeastOnceReconnection : a message not acknowledged is sent again on the new connection of its peer
+func TestAtLeastOnceReconnection(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultDeliveryOptions
+	opts.AckTimeout = time.Second
+	cl.SetDeliveryOptions(opts)
+	aga.SetDeliveryOptions(opts)
+	var m sync.Mutex
+	attempts := 0
+	handled := make(chan msg.Message, 1)
+	aga.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			m.Lock()
+			defer m.Unlock()
+			if attempts++; attempts == 1 {
+				return errors.New("failure")
+			}
+			handled <- message
+			return nil
+		},
+	})
+	// the connection of aga is dialed again whenever it receives nothing for a while
+	aga.SetTimeouts("out", shoset.Timeouts{Idle: 200 * time.Millisecond, Reconnect: true})
+	reconnected := make(chan struct{}, 10)
+	aga.OnConnTimeout(func(c *shoset.ShosetConn, err error) { reconnected <- struct{}{} })
+
+	link(t, aga, cl)
+	time.Sleep(100 * time.Millisecond) // identified by cl
+	conns := cl.GetConnsByTypeArray("aga")
+	if len(conns) == 0 {
+		t.Fatal("no connection to aga")
+	}
+	evt := msg.NewEventClassic("topic", "event", "payload")
+	evt.QoS = msg.QoSAtLeastOnce
+	conns[0].SendMessage(*evt)
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	if len(reconnected) == 0 {
+		t.Error("connection not dialed again")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conns[0].GetPendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if conns[0].GetPendingCount() > 0 {
+		t.Error("message never acknowledged")
+	}
+}
+
+// TestDeliveryOptions : each shoset has its own delivery options
+func TestDeliveryOptions(t *testing.T) {
+	s, other := shoset.NewShoset("test", "cl"), shoset.NewShoset("other", "cl")
+	if err := s.SetDeliveryOptions(shoset.DeliveryOptions{AckTimeout: time.Second}); err == nil {
+		t.Error("options without attempts accepted")
+	}
+	opts := shoset.DeliveryOptions{AckTimeout: time.Second, MaxAttempts: 2, DedupWindow: time.Minute}
+	if err := s.SetDeliveryOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetDeliveryOptions() != opts {
+		t.Errorf("unexpected options %+v", s.GetDeliveryOptions())
+	}
+	if other.GetDeliveryOptions() != shoset.DefaultDeliveryOptions {
+		t.Error("options of another shoset changed")
+	}
+}
@@ -7,6 +7,26 @@ import (
 	"github.com/ditrit/shoset/msg"
 )
 
+// EventHandler : MessageHandlers of the "evt" messages
+type EventHandler struct{}
+
+// Get :
+func (EventHandler) Get(c *ShosetConn) (msg.Message, error) { return GetEvent(c) }
+
+// Handle :
+func (EventHandler) Handle(c *ShosetConn, message msg.Message) error { return HandleEvent(c, message) }
+
+// SendConn :
+func (EventHandler) SendConn(c *ShosetConn, evt msg.Message) error { return c.WriteMessage(evt) }
+
+// Send :
+func (EventHandler) Send(c *Shoset, evt msg.Message) { SendEvent(c, evt) }
+
+// Wait :
+func (EventHandler) Wait(c *Shoset, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	return WaitEvent(c, replies, args, timeout)
+}
+
 // GetEvent :
 func GetEvent(c *ShosetConn) (msg.Message, error) {
 	var evt msg.Event
@@ -18,25 +38,27 @@ func GetEvent(c *ShosetConn) (msg.Message, error) {
 func HandleEvent(c *ShosetConn, message msg.Message) error {
 	evt := message.(msg.Event)
 	fmt.Println("Shoset")
-	c.GetCh().Queue["evt"].Push(evt, c.GetRemoteShosetType(), c.GetLocalAddress())
-	return nil
+	return c.GetCh().GetQueue("evt").Put(evt, c.GetRemoteShosetType(), c.GetLocalAddress())
 }
 
 // SendEventConn :
 func SendEventConn(c *ShosetConn, evt interface{}) {
 	fmt.Print("Sending config.\n")
-	c.WriteString("evt")
-	c.WriteMessage(evt)
+	if m, ok := evt.(msg.Message); ok {
+		c.WriteMessage(m)
+		return
+	}
+	c.out.wm.Lock()
+	defer c.out.wm.Unlock()
+	c.wb.Send("evt", evt)
 }
 
 // SendEvent :
 func SendEvent(c *Shoset, evt msg.Message) {
 	fmt.Print("Sending event.\n")
-	c.ConnsByName.IterateAll(
-		func(key string, conn *ShosetConn) {
-			conn.SendMessage(evt)
-		},
-	)
+	for _, conn := range c.ConnsByName.GetAll() {
+		conn.SendMessage(evt)
+	}
 }
 
 // WaitEvent :
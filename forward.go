@@ -0,0 +1,199 @@
+package shoset
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// DefaultForwardOptions : capacity of the outbox of each peer of the new shosets, changed per
+// shoset with SetForwardOptions ; the messages also expire after their Timeout
+var DefaultForwardOptions = msg.QueueOptions{MaxCount: 10000, MaxBytes: 64 << 20}
+
+// forwarding : outboxes of the peers temporarily unreachable, by logical name
+type forwarding struct {
+	outboxes map[string]*msg.Queue
+	opts     msg.QueueOptions
+	dir      string // persistence of the outboxes, none when empty
+	m        sync.Mutex
+}
+
+func newForwarding() *forwarding {
+	f := new(forwarding)
+	f.outboxes = make(map[string]*msg.Queue)
+	f.opts = DefaultForwardOptions
+	return f
+}
+
+// SetForwardOptions : capacity of the outboxes of the peers created from now on
+func (c *Shoset) SetForwardOptions(opts msg.QueueOptions) {
+	c.forwarding.m.Lock()
+	defer c.forwarding.m.Unlock()
+	c.forwarding.opts = opts
+}
+
+// GetForwardOptions : capacity of the outboxes of the peers created from now on
+func (c *Shoset) GetForwardOptions() msg.QueueOptions {
+	c.forwarding.m.Lock()
+	defer c.forwarding.m.Unlock()
+	return c.forwarding.opts
+}
+
+// UsePersistentForwarding : save the outboxes of the peers created from now on in dir,
+// one sub-directory per peer, so that they survive a restart of the shoset
+func (c *Shoset) UsePersistentForwarding(dir string) {
+	c.forwarding.m.Lock()
+	defer c.forwarding.m.Unlock()
+	c.forwarding.dir = dir
+}
+
+// GetForwardQueue : messages waiting for a peer to be reachable again, nil if there are none
+func (c *Shoset) GetForwardQueue(lName string) *msg.Queue {
+	c.forwarding.m.Lock()
+	defer c.forwarding.m.Unlock()
+	return c.forwarding.outboxes[lName]
+}
+
+// forwardQueue : outbox of a peer, created when needed or to reload it from the disk
+func (c *Shoset) forwardQueue(peer string, create bool) (*msg.Queue, error) {
+	c.forwarding.m.Lock()
+	defer c.forwarding.m.Unlock()
+	if queue, ok := c.forwarding.outboxes[peer]; ok || !(create || c.forwarding.dir != "") {
+		return queue, nil
+	}
+	queue := msg.NewQueueWithOptions(c.forwarding.opts)
+	if c.forwarding.dir != "" {
+		store, err := msg.OpenDiskStore(filepath.Join(c.forwarding.dir, peer), msg.DefaultSegmentSize)
+		if err != nil {
+			return nil, err
+		}
+		persistent, err := msg.NewPersistentQueue(store, c.forwarding.opts)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		queue.Close()
+		queue = persistent
+	}
+	undelivered := func(reason string) func(*msg.Cell) {
+		return func(cell *msg.Cell) {
+			d := msg.NewDeadLetter(cell.GetMessage(), msg.DeadLetterUndelivered, errors.New(reason), c.retention())
+			d.ReceivedAt = cell.GetQueuedAt().UnixNano()
+			d.RemoteLogicalName = peer
+			c.deadLetters.Put(*d, "", "")
+		}
+	}
+	queue.OnExpire(undelivered("expired while " + peer + " was unreachable"))
+	queue.OnDrop(undelivered("outbox of " + peer + " full"))
+	c.forwarding.outboxes[peer] = queue
+	return queue, nil
+}
+
+// forwardable : the message is kept for its peer while it is unreachable
+func (c *Shoset) forwardable(m msg.Message) bool {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	return !c.noForward[m.GetMsgType()]
+}
+
+// peer : key of the outbox of the peer of a connection
+func (c *ShosetConn) peer() string {
+	c.fwd.Lock()
+	defer c.fwd.Unlock()
+	return c.currentPeer()
+}
+
+// currentPeer : key of the outbox of the peer of a connection (fwd held)
+func (c *ShosetConn) currentPeer() string {
+	if c.peerLname != "" {
+		return c.peerLname
+	}
+	return c.GetRemoteAddress()
+}
+
+// forward : keep a message in the outbox of the peer when it is not reachable,
+// return false when the message must be written on the socket
+func (c *ShosetConn) forward(m msg.Message) (bool, error) {
+	c.fwd.Lock()
+	defer c.fwd.Unlock()
+	if c.connected || !c.ch.forwardable(m) {
+		return false, nil
+	}
+	queue, err := c.ch.forwardQueue(c.currentPeer(), true)
+	if err != nil {
+		return true, err
+	}
+	err = queue.Put(m, c.GetRemoteShosetType(), c.GetRemoteAddress())
+	if err == msg.ErrMessageExists { // sent again by the retransmission
+		err = nil
+	}
+	return true, err
+}
+
+// setConnected : a connection of dir "out" is established (the messages kept for its peer
+// are queued for the writer first, oldest first) or lost (its streams are broken)
+func (c *ShosetConn) setConnected(connected bool) {
+	if !connected {
+		c.fwd.Lock()
+		c.connected = false
+		c.fwd.Unlock()
+		c.streams.closeAll(ErrConnClosed)
+		return
+	}
+	// the messages sent meanwhile are still kept, and queued by the next round
+	for {
+		c.fwd.Lock()
+		if c.connected {
+			c.fwd.Unlock()
+			return
+		}
+		kept := c.kept()
+		if len(kept) == 0 {
+			c.connected = true
+			c.fwd.Unlock()
+			return
+		}
+		c.fwd.Unlock()
+		for _, k := range kept {
+			if err := c.push(k.m); err != nil {
+				return // connection closed
+			}
+			k.queue.Remove(k.m.GetUUID())
+		}
+	}
+}
+
+// keptMessage : message kept for the peer of a connection, and its outbox
+type keptMessage struct {
+	queue *msg.Queue
+	m     msg.Message
+}
+
+// kept : messages kept for the peer of a connection, oldest first (fwd held)
+func (c *ShosetConn) kept() []keptMessage {
+	var kept []keptMessage
+	// kept by address before the peer was known the first time
+	peers := []string{c.GetRemoteAddress()}
+	if peer := c.currentPeer(); peer != peers[0] {
+		peers = append(peers, peer)
+	}
+	for _, peer := range peers {
+		queue, _ := c.ch.forwardQueue(peer, false)
+		if queue == nil {
+			continue
+		}
+		for cell := queue.First(); cell != nil; cell = queue.Next(cell.GetMessage().GetUUID()) {
+			kept = append(kept, keptMessage{queue, cell.GetMessage()})
+		}
+	}
+	return kept
+}
+
+// isConnected :
+func (c *ShosetConn) isConnected() bool {
+	c.fwd.Lock()
+	defer c.fwd.Unlock()
+	return c.connected
+}
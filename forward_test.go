@@ -0,0 +1,68 @@
+package shoset_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestStoreAndForward : the messages sent to a peer not reachable yet are delivered once linked
+func TestStoreAndForward(t *testing.T) {
+	clAddress := freeAddress(t)
+	aga := shoset.NewShoset("aga", "aga")
+	aga.Bind(freeAddress(t))
+	conn, err := aga.Protocol(clAddress, "link")
+	if err != nil || conn == nil {
+		t.Fatal("no connection : ", err)
+	}
+
+	sent := make(map[string]bool)
+	for _, payload := range []string{"first", "second", "third"} {
+		evt := msg.NewEventClassic("topic", "event", payload)
+		evt.Timeout = 10000
+		conn.SendMessage(*evt)
+		sent[evt.GetUUID()] = true
+	}
+	if queue := aga.GetForwardQueue(conn.GetRemoteAddress()); queue == nil || queue.IsEmpty() {
+		t.Fatal("messages not kept while the peer is unreachable")
+	}
+
+	cl := shoset.NewShoset("cl", "cl")
+	cl.Bind(clAddress)
+	iter := msg.NewIterator(cl.GetQueue("evt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sent) > 0 {
+		cell := iter.Get()
+		if cell == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d messages not received", len(sent))
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		delete(sent, cell.GetMessage().GetUUID())
+	}
+}
+
+// TestForwardOptions : the outboxes of the peers get the options of their shoset
+func TestForwardOptions(t *testing.T) {
+	aga, other := shoset.NewShoset("aga", "aga"), shoset.NewShoset("other", "aga")
+	opts := msg.QueueOptions{MaxCount: 2}
+	aga.SetForwardOptions(opts)
+	if aga.GetForwardOptions() != opts || other.GetForwardOptions() != shoset.DefaultForwardOptions {
+		t.Errorf("unexpected options %+v and %+v", aga.GetForwardOptions(), other.GetForwardOptions())
+	}
+
+	aga.Bind(freeAddress(t))
+	conn, err := aga.Protocol(freeAddress(t), "link")
+	if err != nil || conn == nil {
+		t.Fatal("no connection : ", err)
+	}
+	conn.SendMessage(*msg.NewEventClassic("topic", "event", "payload"))
+	queue := aga.GetForwardQueue(conn.GetRemoteAddress())
+	if queue == nil || queue.GetOptions() != opts {
+		t.Error("outbox without the options of its shoset")
+	}
+}
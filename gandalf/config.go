@@ -0,0 +1,130 @@
+package gandalf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// Config : gandalf configs
+type Config struct {
+	msg.MessageBase
+	Target  string
+	Command string
+	Context map[string]interface{}
+}
+
+// NewConfig : Config constructor
+// todo : passer une map pour gerer les valeurs optionnelles ?
+func NewConfig(target string, command string, payload string) *Config {
+	c := new(Config)
+	c.InitMessageBase()
+
+	c.Target = target
+	c.Context = make(map[string]interface{})
+	c.Command = command
+	c.Payload = payload
+	return c
+}
+
+// GetMsgType accessor
+func (c Config) GetMsgType() string { return "config" }
+
+// GetTarget :
+func (c Config) GetTarget() string { return c.Target }
+
+// GetCommand :
+func (c Config) GetCommand() string { return c.Command }
+
+// GetContext :
+func (c Config) GetContext() map[string]interface{} { return c.Context }
+
+// ConfigHandler : MessageHandlers of the "config" messages
+type ConfigHandler struct{}
+
+// Get :
+func (ConfigHandler) Get(c *shoset.ShosetConn) (msg.Message, error) { return GetConfig(c) }
+
+// Handle :
+func (ConfigHandler) Handle(c *shoset.ShosetConn, message msg.Message) error {
+	return HandleConfig(c, message)
+}
+
+// SendConn :
+func (ConfigHandler) SendConn(c *shoset.ShosetConn, conf msg.Message) error {
+	return c.WriteMessage(conf)
+}
+
+// Send :
+func (ConfigHandler) Send(c *shoset.Shoset, conf msg.Message) { SendConfig(c, conf) }
+
+// Wait :
+func (ConfigHandler) Wait(c *shoset.Shoset, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	return WaitConfig(c, replies, args, timeout)
+}
+
+// ConfigSpec : the "config" message type
+var ConfigSpec = shoset.MessageTypeSpec{Handlers: ConfigHandler{}, Type: Config{}}
+
+// Register : add the gandalf message types to a shoset
+func Register(s *shoset.Shoset) error {
+	return s.RegisterMessageType("config", ConfigSpec)
+}
+
+// GetConfig :
+func GetConfig(c *shoset.ShosetConn) (msg.Message, error) {
+	var conf Config
+	err := c.ReadMessage(&conf)
+	return conf, err
+}
+
+// HandleConfig : queue a received config with the commands, as they are waited for together
+func HandleConfig(c *shoset.ShosetConn, message msg.Message) error {
+	conf := message.(Config)
+	return c.GetCh().GetQueue("cmd").Put(conf, c.GetRemoteShosetType(), c.GetLocalAddress())
+}
+
+// SendConfig :
+func SendConfig(c *shoset.Shoset, cmd msg.Message) {
+	fmt.Print("Sending Config.\n")
+	for _, conn := range c.ConnsByName.GetAll() {
+		conn.SendMessage(cmd)
+	}
+}
+
+// WaitConfig :
+func WaitConfig(c *shoset.Shoset, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	commandName, ok := args["name"]
+	if !ok {
+		return nil
+	}
+	term := make(chan *msg.Message, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if cell := replies.Get(); cell != nil {
+				message := cell.GetMessage()
+				if config, ok := message.(Config); ok && config.GetCommand() == commandName {
+					term <- &message
+					return
+				}
+			} else {
+				time.Sleep(time.Duration(10) * time.Millisecond)
+			}
+		}
+	}()
+	select {
+	case res := <-term:
+		return res
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package gandalf_test
+
+import (
+	"testing"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/gandalf"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestRegister : the config type is added to a shoset with its queue
+func TestRegister(t *testing.T) {
+	s := shoset.NewShoset("test", "cl")
+	if s.GetHandlers("config") != nil {
+		t.Fatal("config registered by the shoset itself")
+	}
+	if err := gandalf.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.GetHandlers("config").(gandalf.ConfigHandler); !ok {
+		t.Errorf("unexpected handlers for config : %T", s.GetHandlers("config"))
+	}
+	queue := s.GetQueue("config")
+	if queue == nil {
+		t.Fatal("no queue for config")
+	}
+
+	replies := msg.NewIterator(queue)
+	queue.Put(*gandalf.NewConfig("target", "deploy", "payload"), "aga", "remote")
+	m := s.WaitMessage("config", replies, map[string]string{"name": "deploy"}, 1)
+	if m == nil || (*m).(gandalf.Config).GetTarget() != "target" {
+		t.Errorf("config not waited for : %v", m)
+	}
+}
+
+// TestHandleConfig : a received config is queued with the commands
+func TestHandleConfig(t *testing.T) {
+	s := shoset.NewShoset("test", "cl")
+	gandalf.Register(s)
+	conn, err := shoset.NewShosetConn(s, "localhost:8001", "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := msg.NewIterator(s.GetQueue("cmd"))
+	if err := gandalf.HandleConfig(conn, *gandalf.NewConfig("target", "deploy", "payload")); err != nil {
+		t.Fatal(err)
+	}
+	m := gandalf.WaitConfig(s, replies, map[string]string{"name": "deploy"}, 1)
+	if m == nil || (*m).(gandalf.Config).GetTarget() != "target" {
+		t.Errorf("config not queued with the commands : %v", m)
+	}
+	if s.GetQueue("config").First() != nil {
+		t.Error("config queued apart from the commands")
+	}
+}
@@ -1,8 +1,10 @@
 module github.com/ditrit/shoset
 
-go 1.14
+go 1.15
 
 require (
 	github.com/kjk/betterguid v0.0.0-20170621091430-c442874ba63a
+	github.com/klauspost/compress v1.15.0
 	github.com/spf13/viper v1.8.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 )
@@ -0,0 +1,79 @@
+package shoset_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestMain : the shosets save their links in the home directory and link again to them when they
+// are bound to the same address, the tests use a home directory of their own
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "shoset_home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// bind : bind a shoset to a free local port
+func bind(t *testing.T, s *shoset.Shoset) {
+	if err := s.Bind("localhost:0"); err != nil {
+		t.Skip("unable to listen : ", err)
+	}
+}
+
+// newShosets : a "cl" and an "aga" shosets bound to free local ports
+func newShosets(t *testing.T) (*shoset.Shoset, *shoset.Shoset) {
+	cl := shoset.NewShoset("cl", "cl")
+	bind(t, cl)
+	aga := shoset.NewShoset("aga", "aga")
+	bind(t, aga)
+	return cl, aga
+}
+
+// link : link from to to, and return the connection of from
+func link(t *testing.T, from, to *shoset.Shoset) *shoset.ShosetConn {
+	from.Protocol(to.GetBindAddress(), "link")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(from.GetConnsByTypeArray(to.GetShosetType())) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	conns := from.GetConnsByTypeArray(to.GetShosetType())
+	if len(conns) == 0 {
+		t.Fatal("link not established")
+	}
+	return conns[0]
+}
+
+// waitDeadLetter : next dead letter of a shoset
+func waitDeadLetter(t *testing.T, iter *msg.Iterator) (*msg.Cell, msg.DeadLetter) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cell := iter.Get(); cell != nil {
+			return cell, cell.GetMessage().(msg.DeadLetter)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no dead letter")
+	return nil, msg.DeadLetter{}
+}
+
+// freeAddress : local address with a port nobody listens to, for a peer bound after being dialed ;
+// the port may be taken meanwhile, bind the other shosets to port 0
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Skip("unable to listen : ", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
@@ -0,0 +1,53 @@
+package shoset
+
+import (
+	"github.com/ditrit/shoset/msg"
+)
+
+// Handler : processing of a message received from, or sent to, the peer of a connection
+type Handler func(*ShosetConn, msg.Message) error
+
+// Interceptor : wraps the next Handler of a chain. It can inspect or mutate the message before
+// passing it on, drop it by not calling next, or reroute it by sending it somewhere else.
+type Interceptor func(next Handler) Handler
+
+// UseInbound : add interceptors to the messages received, run in the order of registration
+// before the Handle function of their type
+func (c *Shoset) UseInbound(interceptors ...Interceptor) {
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	c.inbound = append(append([]Interceptor{}, c.inbound...), interceptors...)
+}
+
+// UseOutbound : add interceptors to the messages sent, run in the order of registration
+// before the message is written on the socket
+func (c *Shoset) UseOutbound(interceptors ...Interceptor) {
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	c.outbound = append(append([]Interceptor{}, c.outbound...), interceptors...)
+}
+
+// inboundHandler : chain of the inbound interceptors ending with last
+func (c *Shoset) inboundHandler(last Handler) Handler {
+	c.typesLock.RLock()
+	interceptors := c.inbound
+	c.typesLock.RUnlock()
+	return chain(interceptors, last)
+}
+
+// outboundHandler : chain of the outbound interceptors ending with last
+func (c *Shoset) outboundHandler(last Handler) Handler {
+	c.typesLock.RLock()
+	interceptors := c.outbound
+	c.typesLock.RUnlock()
+	return chain(interceptors, last)
+}
+
+// chain : the first interceptor is the outermost one
+func chain(interceptors []Interceptor, last Handler) Handler {
+	h := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		h = interceptors[i](h)
+	}
+	return h
+}
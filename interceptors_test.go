@@ -0,0 +1,61 @@
+package shoset_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestInterceptors : test mutating sent messages and dropping received ones
+func TestInterceptors(t *testing.T) {
+	cl, aga := newShosets(t)
+
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if evt, ok := m.(msg.Event); ok {
+				evt.Payload += " (intercepted)"
+				m = evt
+			}
+			return next(c, m)
+		}
+	})
+	cl.UseInbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if evt, ok := m.(msg.Event); ok && evt.GetTopic() == "drop" {
+				return nil
+			}
+			return next(c, m)
+		}
+	})
+
+	aga.Protocol(cl.GetBindAddress(), "link")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(aga.GetConnsByTypeArray("cl")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	conns := aga.GetConnsByTypeArray("cl")
+	if len(conns) == 0 {
+		t.Fatal("link not established")
+	}
+	conns[0].SendMessage(*msg.NewEventClassic("drop", "event", "dropped"))
+	conns[0].SendMessage(*msg.NewEventClassic("keep", "event", "payload"))
+
+	iter := msg.NewIterator(cl.GetQueue("evt"))
+	var cell *msg.Cell
+	for cell == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		cell = iter.Get()
+	}
+	if cell == nil {
+		t.Fatal("event not received")
+	}
+	evt := cell.GetMessage().(msg.Event)
+	if evt.GetTopic() != "keep" || evt.GetPayload() != "payload (intercepted)" {
+		t.Errorf("unexpected event %s : %s", evt.GetTopic(), evt.GetPayload())
+	}
+	if cell = iter.Get(); cell != nil {
+		t.Errorf("unexpected message after the event : %v", cell.GetMessage())
+	}
+}
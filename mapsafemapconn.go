@@ -150,6 +150,16 @@ func (m *MapSafeMapConn) IterateAll(iter func(string, *ShosetConn)) {
 	m.Unlock()
 }
 
+// GetAll : connections of every logical name, to write on them once the map is unlocked
+// (a message kept for an unreachable peer may be written on the disk)
+func (m *MapSafeMapConn) GetAll() []*ShosetConn {
+	var conns []*ShosetConn
+	m.IterateAll(func(key string, conn *ShosetConn) {
+		conns = append(conns, conn)
+	})
+	return conns
+}
+
 // Len : return length of the map
 func (m *MapSafeMapConn) Len() int {
 	return len(m.m)
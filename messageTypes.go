@@ -0,0 +1,309 @@
+package shoset
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// MessageTypeSpec : behaviour of a type of message registered with RegisterMessageType,
+// given either as a MessageHandlers object or as functions
+type MessageTypeSpec struct {
+	Handlers MessageHandlers // takes precedence over the functions below
+
+	Get    func(*ShosetConn) (msg.Message, error)                            // decode a received message, required without Handlers
+	Handle func(*ShosetConn, msg.Message) error                              // process a received message
+	Send   func(*Shoset, msg.Message)                                        // send a message to the peers
+	Wait   func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message // wait for a message in the queue
+
+	NoQueue      bool             // the received messages are not queued
+	NoForward    bool             // the messages are not kept for a peer while it is unreachable
+	Control      bool             // the messages are written before the others, whatever their priority
+	QueueOptions msg.QueueOptions // capacity of the queue
+	Type         msg.Message      // value of the concrete type of the messages, to save them in persistent queues
+
+	Ordering Ordering                 // execution order of the handlers, Concurrent by default
+	OrderKey func(msg.Message) string // key of the messages handled in order with OrderedByKey
+	Pool     PoolOptions              // workers handling the messages, a goroutine per message by default
+}
+
+// specHandlers : MessageHandlers made of the functions of a MessageTypeSpec
+type specHandlers struct {
+	spec MessageTypeSpec
+}
+
+func (h specHandlers) Get(c *ShosetConn) (msg.Message, error) { return h.spec.Get(c) }
+
+func (h specHandlers) Handle(c *ShosetConn, m msg.Message) error {
+	if h.spec.Handle == nil {
+		return nil
+	}
+	return h.spec.Handle(c, m)
+}
+
+func (h specHandlers) SendConn(c *ShosetConn, m msg.Message) error { return c.WriteMessage(m) }
+
+func (h specHandlers) Send(c *Shoset, m msg.Message) {
+	if h.spec.Send != nil {
+		h.spec.Send(c, m)
+	}
+}
+
+func (h specHandlers) Wait(c *Shoset, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	if h.spec.Wait == nil {
+		return nil
+	}
+	return h.spec.Wait(c, replies, args, timeout)
+}
+
+// RegisterMessageType : add (or replace) a type of message, safe to call while the shoset is running
+func (c *Shoset) RegisterMessageType(name string, spec MessageTypeSpec) error {
+	if name == "" || (spec.Handlers == nil && spec.Get == nil) {
+		return errors.New("RegisterMessageType : a message type needs a name and handlers or a Get function")
+	}
+	if spec.Ordering == OrderedByKey && spec.OrderKey == nil {
+		return errors.New("RegisterMessageType : OrderedByKey needs an OrderKey function")
+	}
+	if spec.Type != nil {
+		msg.RegisterType(spec.Type)
+	}
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+
+	if old, ok := c.queues[name]; ok {
+		delete(c.queues, name)
+		old.Close()
+	}
+	if !spec.NoQueue {
+		c.queues[name] = msg.NewQueueWithOptions(spec.QueueOptions)
+		c.watchExpiry(c.queues[name])
+	}
+	c.noForward[name] = spec.NoForward
+	c.control[name] = spec.Control
+	c.orderings[name] = ordering{spec.Ordering, spec.OrderKey}
+	c.setPool(name, spec.Pool)
+	if spec.Handlers != nil {
+		c.setHandlers(name, spec.Handlers, true, true)
+	} else {
+		c.setHandlers(name, specHandlers{spec}, spec.Send != nil, spec.Wait != nil)
+	}
+	return nil
+}
+
+// SetHandlers : replace the handlers of a registered type of message, keeping its queue,
+// typically to decorate them : s.SetHandlers("evt", logged{s.GetHandlers("evt")})
+func (c *Shoset) SetHandlers(name string, h MessageHandlers) error {
+	if h == nil {
+		return errors.New("SetHandlers : nil handlers for message type " + name)
+	}
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	if _, ok := c.handlers[name]; !ok {
+		return errors.New("SetHandlers : unknown message type " + name)
+	}
+	c.setHandlers(name, h, true, true)
+	return nil
+}
+
+// GetHandlers : handlers of a type of message, nil if it is not registered
+func (c *Shoset) GetHandlers(name string) MessageHandlers {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	return c.handlers[name]
+}
+
+// setHandlers : record the handlers of a type and their Send and Wait methods when they have some (typesLock held)
+func (c *Shoset) setHandlers(name string, h MessageHandlers, canSend, canWait bool) {
+	c.handlers[name] = h
+	delete(c.send, name)
+	if canSend {
+		c.send[name] = h.Send
+	}
+	delete(c.wait, name)
+	if canWait {
+		c.wait[name] = h.Wait
+	}
+}
+
+// GetQueue : queue of a type of message, nil if there is none
+func (c *Shoset) GetQueue(msgType string) *msg.Queue {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	return c.queues[msgType]
+}
+
+// Queue : queues by type of message, a copy
+//
+// Deprecated: use GetQueue, and RegisterMessageType or SetQueueOptions to change them.
+func (c *Shoset) Queue() map[string]*msg.Queue {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	queues := make(map[string]*msg.Queue, len(c.queues))
+	for msgType, queue := range c.queues {
+		queues[msgType] = queue
+	}
+	return queues
+}
+
+// Get : decoders by type of message, a copy
+//
+// Deprecated: use GetHandlers, and RegisterMessageType to change them.
+func (c *Shoset) Get() map[string]func(*ShosetConn) (msg.Message, error) {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	get := make(map[string]func(*ShosetConn) (msg.Message, error), len(c.handlers))
+	for msgType, h := range c.handlers {
+		get[msgType] = h.Get
+	}
+	return get
+}
+
+// Handle : handlers by type of message, a copy
+//
+// Deprecated: use GetHandlers, and RegisterMessageType or SetHandlers to change them.
+func (c *Shoset) Handle() map[string]func(*ShosetConn, msg.Message) error {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	handle := make(map[string]func(*ShosetConn, msg.Message) error, len(c.handlers))
+	for msgType, h := range c.handlers {
+		handle[msgType] = h.Handle
+	}
+	return handle
+}
+
+// Send : Send functions by type of message, a copy
+//
+// Deprecated: use SendMessage, and RegisterMessageType to change them.
+func (c *Shoset) Send() map[string]func(*Shoset, msg.Message) {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	send := make(map[string]func(*Shoset, msg.Message), len(c.send))
+	for msgType, f := range c.send {
+		send[msgType] = f
+	}
+	return send
+}
+
+// Wait : Wait functions by type of message, a copy
+//
+// Deprecated: use WaitMessage, and RegisterMessageType to change them.
+func (c *Shoset) Wait() map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	wait := make(map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message, len(c.wait))
+	for msgType, f := range c.wait {
+		wait[msgType] = f
+	}
+	return wait
+}
+
+// setQueue : replace the queue of a type of message
+func (c *Shoset) setQueue(msgType string, queue *msg.Queue) {
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	c.queues[msgType] = queue
+	c.watchExpiry(queue)
+}
+
+// getHandlers : handlers of a type of message
+func (c *Shoset) getHandlers(msgType string) (MessageHandlers, bool) {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	h, ok := c.handlers[msgType]
+	return h, ok
+}
+
+// SetFallbackHandler : handler of the messages of unknown types, received as msg.Unknown
+// after the inbound interceptors, nil to send them to the dead-letter queue
+func (c *Shoset) SetFallbackHandler(h Handler) {
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	c.fallback = h
+}
+
+// GetUnknownCounts : number of messages received per unknown type
+func (c *Shoset) GetUnknownCounts() map[string]int64 {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	counts := make(map[string]int64, len(c.unknownCounts))
+	for msgType, count := range c.unknownCounts {
+		counts[msgType] = count
+	}
+	return counts
+}
+
+// handleUnknown : count a message of an unknown type and pass it to the fallback handler,
+// or to the dead-letter queue without fallback handler
+func (c *Shoset) handleUnknown(conn *ShosetConn, unknown msg.Unknown, receivedAt time.Time) {
+	c.typesLock.Lock()
+	c.unknownCounts[unknown.GetMsgType()]++
+	fallback := c.fallback
+	c.typesLock.Unlock()
+	if fallback == nil {
+		c.deadLetter(conn, unknown, msg.DeadLetterNoRoute, nil, receivedAt)
+		return
+	}
+	go c.dispatch(conn, fallback, unknown, msg.FrameMeta{}, receivedAt)
+}
+
+// SendMessage : send a message to the peers with the Send function of its type
+func (c *Shoset) SendMessage(m msg.Message) error {
+	c.typesLock.RLock()
+	f, ok := c.send[m.GetMsgType()]
+	c.typesLock.RUnlock()
+	if !ok {
+		return errors.New("SendMessage : no Send function for message type " + m.GetMsgType())
+	}
+	f(c, m)
+	return nil
+}
+
+// WaitMessage : wait for a message with the Wait function of its type
+func (c *Shoset) WaitMessage(msgType string, replies *msg.Iterator, args map[string]string, timeout int) *msg.Message {
+	c.typesLock.RLock()
+	f, ok := c.wait[msgType]
+	c.typesLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return f(c, replies, args, timeout)
+}
+
+// protocolHandler : SendConn, Send and Wait of the messages of the shoset protocol, which are not waited for
+type protocolHandler struct{}
+
+// SendConn :
+func (protocolHandler) SendConn(c *ShosetConn, m msg.Message) error { return c.WriteMessage(m) }
+
+// Send :
+func (protocolHandler) Send(c *Shoset, m msg.Message) {
+	for _, conn := range c.ConnsByName.GetAll() {
+		conn.WriteMessage(m)
+	}
+}
+
+// Wait :
+func (protocolHandler) Wait(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message { return nil }
+
+// registerBuiltinTypes : types of message of the shoset protocol, their specs are valid
+func (c *Shoset) registerBuiltinTypes() {
+	builtins := []struct {
+		name string
+		spec MessageTypeSpec
+	}{
+		{"cfglink", MessageTypeSpec{Handlers: ConfigLinkHandler{}, NoForward: true, Control: true}},
+		{"cfgjoin", MessageTypeSpec{Handlers: ConfigJoinHandler{}, NoForward: true, Control: true}},
+		{"cfgbye", MessageTypeSpec{Handlers: ConfigByeHandler{}, NoForward: true, Control: true}},
+		{"evt", MessageTypeSpec{Handlers: EventHandler{}}},
+		{"cmd", MessageTypeSpec{Handlers: CommandHandler{}}},
+		{"xfer", MessageTypeSpec{Handlers: TransferHandler{}, NoQueue: true, NoForward: true}},
+		{"stream", MessageTypeSpec{Handlers: StreamHandler{}, NoQueue: true, NoForward: true, Ordering: OrderedBySender}},
+		{"ack", MessageTypeSpec{Handlers: AckHandler{}, NoQueue: true, NoForward: true, Control: true}},
+	}
+	for _, builtin := range builtins {
+		if err := c.RegisterMessageType(builtin.name, builtin.spec); err != nil {
+			panic(err)
+		}
+	}
+}
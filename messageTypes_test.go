@@ -0,0 +1,245 @@
+package shoset_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// mockHandlers : MessageHandlers recording the messages sent
+type mockHandlers struct {
+	shoset.EventHandler
+	sent []msg.Message
+}
+
+func (h *mockHandlers) Send(c *shoset.Shoset, m msg.Message) { h.sent = append(h.sent, m) }
+
+// countingHandlers : decorator counting the messages sent through other handlers
+type countingHandlers struct {
+	shoset.MessageHandlers
+	count int
+}
+
+func (h *countingHandlers) Send(c *shoset.Shoset, m msg.Message) {
+	h.count++
+	h.MessageHandlers.Send(c, m)
+}
+
+// TestMessageHandlers : test registering, decorating and mocking handlers
+func TestMessageHandlers(t *testing.T) {
+	s := shoset.NewShoset("test", "cl")
+	if _, ok := s.GetHandlers("evt").(shoset.EventHandler); !ok {
+		t.Fatalf("unexpected handlers for evt : %T", s.GetHandlers("evt"))
+	}
+
+	mock := new(mockHandlers)
+	if err := s.RegisterMessageType("evt", shoset.MessageTypeSpec{Handlers: mock}); err != nil {
+		t.Fatal(err)
+	}
+	queue := s.GetQueue("evt")
+	if queue == nil {
+		t.Fatal("no queue for evt")
+	}
+
+	counter := &countingHandlers{MessageHandlers: s.GetHandlers("evt")}
+	if err := s.SetHandlers("evt", counter); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetQueue("evt") != queue {
+		t.Error("SetHandlers replaced the queue")
+	}
+	if err := s.SendMessage(msg.NewEventClassic("topic", "event", "payload")); err != nil {
+		t.Fatal(err)
+	}
+	if counter.count != 1 || len(mock.sent) != 1 {
+		t.Errorf("decorated send : %d counted, %d sent", counter.count, len(mock.sent))
+	}
+
+	if err := s.SetHandlers("unknown", counter); err == nil {
+		t.Error("SetHandlers accepted an unknown message type")
+	}
+	if err := s.RegisterMessageType("empty", shoset.MessageTypeSpec{}); err == nil {
+		t.Error("RegisterMessageType accepted a type without handlers")
+	}
+}
+
+// TestUnknownMessageType : a message of a type the receiver does not know keeps the connection open
+func TestUnknownMessageType(t *testing.T) {
+	cl, aga := newShosets(t)
+	fallback := make(chan msg.Message, 1)
+	cl.SetFallbackHandler(func(c *shoset.ShosetConn, m msg.Message) error {
+		fallback <- m
+		return nil
+	})
+
+	aga.Protocol(cl.GetBindAddress(), "link")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(aga.GetConnsByTypeArray("cl")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	conns := aga.GetConnsByTypeArray("cl")
+	if len(conns) == 0 {
+		t.Fatal("link not established")
+	}
+	conns[0].SendMessage(newerMessage{*msg.NewEventClassic("topic", "event", "newer")})
+	conns[0].SendMessage(*msg.NewEventClassic("topic", "event", "payload"))
+
+	select {
+	case m := <-fallback:
+		if unknown, ok := m.(msg.Unknown); !ok || unknown.GetMsgType() != "newer" {
+			t.Errorf("unexpected fallback message %#v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fallback handler not called")
+	}
+	iter := msg.NewIterator(cl.GetQueue("evt"))
+	var cell *msg.Cell
+	for cell == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		cell = iter.Get()
+	}
+	if cell == nil {
+		t.Fatal("connection closed by the unknown message")
+	}
+	if count := cl.GetUnknownCounts()["newer"]; count != 1 {
+		t.Errorf("%d unknown messages counted", count)
+	}
+}
+
+// newerMessage : message type of a newer peer
+type newerMessage struct {
+	msg.Event
+}
+
+func (newerMessage) GetMsgType() string { return "newer" }
+
+// TestRegisterMessageType : a type given as functions is received by its peer, and is replaced while linked
+func TestRegisterMessageType(t *testing.T) {
+	cl, aga := newShosets(t)
+	notes := make(chan msg.Message, 1)
+	spec := shoset.MessageTypeSpec{
+		Get: func(c *shoset.ShosetConn) (msg.Message, error) {
+			var evt msg.Event
+			err := c.ReadMessage(&evt)
+			return noteMessage{evt}, err
+		},
+		Handle: func(c *shoset.ShosetConn, m msg.Message) error {
+			notes <- m
+			return nil
+		},
+		NoQueue: true,
+	}
+	if err := cl.RegisterMessageType("note", spec); err != nil {
+		t.Fatal(err)
+	}
+	aga.RegisterMessageType("note", spec)
+	if cl.GetQueue("note") != nil {
+		t.Error("queue created with NoQueue")
+	}
+	if err := cl.SendMessage(noteMessage{*msg.NewEventClassic("topic", "event", "note")}); err == nil {
+		t.Error("SendMessage accepted a type without Send function")
+	}
+
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // connected
+	conn.SendMessage(noteMessage{*msg.NewEventClassic("topic", "event", "first")})
+	select {
+	case m := <-notes:
+		if m.(noteMessage).GetPayload() != "first" {
+			t.Errorf("unexpected note %#v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("note not handled")
+	}
+
+	old := cl.GetQueue("evt")
+	replaced := make(chan msg.Message, 1)
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, m msg.Message) error {
+			replaced <- m
+			return nil
+		},
+	})
+	if queue := cl.GetQueue("evt"); queue == nil || queue == old {
+		t.Error("queue of the replaced type kept")
+	}
+	conn.SendMessage(*msg.NewEventClassic("topic", "event", "second"))
+	select {
+	case m := <-replaced:
+		if m.(msg.Event).GetPayload() != "second" {
+			t.Errorf("unexpected event %#v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replacing handler not called")
+	}
+}
+
+// TestDeprecatedMaps : the former maps of the types of message are still readable
+func TestDeprecatedMaps(t *testing.T) {
+	s := shoset.NewShoset("test", "cl")
+	if queue := s.Queue()["evt"]; queue == nil || queue != s.GetQueue("evt") {
+		t.Error("Queue does not return the queue of evt")
+	}
+	if s.Get()["cmd"] == nil || s.Handle()["cmd"] == nil || s.Send()["cmd"] == nil || s.Wait()["cmd"] == nil {
+		t.Error("functions of cmd missing")
+	}
+	delete(s.Queue(), "evt")
+	if s.GetQueue("evt") == nil {
+		t.Error("queue removed through a copy")
+	}
+}
+
+// TestRegisterPersistentType : the messages of a type registered with its Type are saved and reloaded by a disk store
+func TestRegisterPersistentType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shoset_types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := shoset.NewShoset("test", "cl")
+	err = s.RegisterMessageType("note", shoset.MessageTypeSpec{Get: shoset.GetEvent, Type: noteMessage{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := msg.OpenDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := msg.NewPersistentQueue(store, msg.QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Put(noteMessage{*msg.NewEventClassic("topic", "event", "saved")}, "aga", "remote"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	store, err = msg.OpenDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cells, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 {
+		t.Fatalf("expected 1 message reloaded, got %d", len(cells))
+	}
+	if note, ok := cells[0].GetMessage().(noteMessage); !ok || note.GetPayload() != "saved" {
+		t.Errorf("unexpected message reloaded %#v", cells[0].GetMessage())
+	}
+}
+
+// noteMessage : message type registered by a test
+type noteMessage struct {
+	msg.Event
+}
+
+func (noteMessage) GetMsgType() string { return "note" }
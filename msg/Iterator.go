@@ -9,6 +9,8 @@ type Iterator struct {
 	queue *Queue
 	//seen    map[string]bool
 	current string
+	name    string      // named iterators only
+	offsets OffsetStore // named iterators only
 	m       sync.Mutex
 }
 
@@ -16,7 +18,17 @@ type Iterator struct {
 func NewIterator(queue *Queue) *Iterator {
 	i := new(Iterator)
 	i.Init(queue)
+	queue.m.Lock()
 	queue.iters[i] = true
+	queue.m.Unlock()
+	return i
+}
+
+// NewIteratorFrom : constructor of an iterator resuming after the message position
+// (as returned by GetPosition), even if this message is no longer in the queue
+func NewIteratorFrom(queue *Queue, position string) *Iterator {
+	i := NewIterator(queue)
+	i.Seek(position)
 	return i
 }
 
@@ -28,14 +40,37 @@ func (i *Iterator) Init(queue *Queue) {
 
 // Close : fermeture de l'iterateur
 func (i *Iterator) Close() {
+	i.queue.m.Lock()
+	defer i.queue.m.Unlock()
 	delete(i.queue.iters, i)
 }
 
+// GetPosition : UUID of the last message returned by Get
+func (i *Iterator) GetPosition() string {
+	i.queue.m.Lock()
+	defer i.queue.m.Unlock()
+	return i.current
+}
+
+// Seek : position the iterator so that Get returns the message following position
+func (i *Iterator) Seek(position string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.queue.m.Lock()
+	defer i.queue.m.Unlock()
+	i.current = i.queue.seek(position)
+}
+
 // Get : get next unseen element
 func (i *Iterator) Get() *Cell {
 	i.m.Lock()
 	defer i.m.Unlock()
 
+	// la position de l'iterateur est protégée par le verrou de la queue
+	// (elle est modifiée lors de la suppression d'un message)
+	i.queue.m.Lock()
+	defer i.queue.m.Unlock()
+
 	var cell *Cell
 	// Si la queue est vide, on ne renvoie rien
 	if i.queue.IsEmpty() {
@@ -44,14 +79,15 @@ func (i *Iterator) Get() *Cell {
 
 	// Si l'iterateur n'a pas été initialisé,
 	if i.current == "" {
-		cell = i.queue.First() // premiere cell de la queue
+		cell = i.queue.first() // premiere cell de la queue
 	} else {
-		cell = i.queue.Next(i.current) // cell suivante
+		cell = i.queue.next(i.current) // cell suivante
 	}
 
 	// si on a trouvé un nouveau message à renvoyer
 	if cell != nil {
 		i.current = (*cell).GetMessage().GetUUID() // on pointe dessus
+		i.queue.markRead(i.current)
 	}
 	return cell
 
@@ -0,0 +1,21 @@
+package msg
+
+// Ack : acknowledgement of a message sent with QoSAtLeastOnce, once handled by the receiver
+type Ack struct {
+	MessageBase
+	AckedUUID string
+}
+
+// NewAck : Ack constructor
+func NewAck(uuid string) *Ack {
+	a := new(Ack)
+	a.InitMessageBase()
+	a.AckedUUID = uuid
+	return a
+}
+
+// GetMsgType accessor
+func (a Ack) GetMsgType() string { return "ack" }
+
+// GetAckedUUID accessor
+func (a Ack) GetAckedUUID() string { return a.AckedUUID }
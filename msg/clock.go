@@ -0,0 +1,76 @@
+package msg
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxClockDrift : max drift of the new clocks, see Clock.SetMaxDrift
+const DefaultMaxClockDrift = time.Minute
+
+// Clock : hybrid logical clock in nanoseconds, ahead of the wall clock only to stay
+// after the clocks of the messages received
+type Clock struct {
+	last     int64
+	maxDrift time.Duration
+	m        sync.Mutex
+}
+
+// NewClock : clock moved at most maxDrift ahead of the wall clock by the clocks it observes
+func NewClock(maxDrift time.Duration) *Clock {
+	c := new(Clock)
+	c.maxDrift = maxDrift
+	return c
+}
+
+var clock = NewClock(DefaultMaxClockDrift)
+
+// ProcessClock : clock of the messages created by the process, see ClockNow
+func ProcessClock() *Clock { return clock }
+
+// SetMaxDrift : advance on the wall clock a received clock can give to the clock,
+// a peer with a clock further in the future only moves it that far
+func (c *Clock) SetMaxDrift(maxDrift time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.maxDrift = maxDrift
+}
+
+// GetMaxDrift : advance on the wall clock a received clock can give to the clock
+func (c *Clock) GetMaxDrift() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.maxDrift
+}
+
+// Now : value of the clock, greater than all the values read or observed before
+func (c *Clock) Now() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now().UnixNano()
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+	return now
+}
+
+// Observe : move the clock after the clock of a received message, up to its max drift
+// ahead of the wall clock
+func (c *Clock) Observe(remote int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if limit := time.Now().Add(c.maxDrift).UnixNano(); remote > limit {
+		remote = limit
+	}
+	if remote > c.last {
+		c.last = remote
+	}
+}
+
+// ClockNow : hybrid logical clock of the process, in nanoseconds
+func ClockNow() int64 { return clock.Now() }
+
+// ObserveClock : keep the clock of the process after the clock of a received message,
+// so that the messages created next are ordered after it, unless it drifts too far
+func ObserveClock(remote int64) { clock.Observe(remote) }
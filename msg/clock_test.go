@@ -0,0 +1,46 @@
+package msg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestClock : the clocks of the messages of a process strictly increase, even after the clock
+// of a message from the future, which moves it its max drift ahead at most
+func TestClock(t *testing.T) {
+	first := msg.NewEventClassic("topic", "event", "first")
+	observed := time.Now().Add(time.Second).UnixNano()
+	msg.ObserveClock(observed)
+	second := msg.NewEventClassic("topic", "event", "second")
+
+	if second.GetClock() <= first.GetClock() || second.GetClock() <= observed {
+		t.Errorf("clock not moved after the observed one : %d then %d", first.GetClock(), second.GetClock())
+	}
+	if third := msg.NewEventClassic("topic", "event", "third"); third.GetClock() <= second.GetClock() {
+		t.Errorf("clock going back : %d then %d", second.GetClock(), third.GetClock())
+	}
+
+	msg.ObserveClock(time.Now().Add(time.Hour).UnixNano())
+	if fourth := msg.NewEventClassic("topic", "event", "fourth"); fourth.GetClock() > time.Now().Add(msg.ProcessClock().GetMaxDrift()).UnixNano() {
+		t.Errorf("clock moved beyond its max drift : %d", fourth.GetClock()-time.Now().UnixNano())
+	}
+}
+
+// TestClockMaxDrift : each clock has its own max drift
+func TestClockMaxDrift(t *testing.T) {
+	c := msg.NewClock(time.Second)
+	c.Observe(time.Now().Add(time.Hour).UnixNano())
+	if now := c.Now(); now > time.Now().Add(time.Second).UnixNano() {
+		t.Errorf("clock moved beyond its max drift : %d", now-time.Now().UnixNano())
+	}
+	c.SetMaxDrift(time.Hour)
+	c.Observe(time.Now().Add(time.Hour).UnixNano())
+	if now := c.Now(); now < time.Now().Add(time.Minute).UnixNano() {
+		t.Error("larger max drift not applied")
+	}
+	if msg.ProcessClock().GetMaxDrift() != msg.DefaultMaxClockDrift {
+		t.Error("max drift of the process clock changed")
+	}
+}
@@ -0,0 +1,143 @@
+package msg
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoder : encode the values written on a connection
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder : decode the values read from a connection
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Skipper : decoder able to drop the next value without knowing its type,
+// used for the messages of unknown types (decoded in an interface{} otherwise)
+type Skipper interface {
+	Skip() error
+}
+
+// Codec : wire format of the messages, the encoder and the decoder are created
+// once per connection so that stateful formats keep their state between messages
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r *bufio.Reader) Decoder // must not read past the end of a value
+}
+
+// DefaultCodec : codec used before the negotiation and with peers not negotiating
+const DefaultCodec = "gob"
+
+var codecs = struct {
+	byName map[string]Codec
+	names  []string // preference order
+	m      sync.Mutex
+}{byName: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(gobCodec{})
+	RegisterCodec(jsonCodec{})
+}
+
+// RegisterCodec : make a codec available for the negotiation, the codecs
+// registered first are preferred
+func RegisterCodec(c Codec) {
+	codecs.m.Lock()
+	defer codecs.m.Unlock()
+	if _, ok := codecs.byName[c.Name()]; !ok {
+		codecs.names = append(codecs.names, c.Name())
+	}
+	codecs.byName[c.Name()] = c
+}
+
+// GetCodec : codec registered under name
+func GetCodec(name string) (Codec, bool) {
+	codecs.m.Lock()
+	defer codecs.m.Unlock()
+	c, ok := codecs.byName[name]
+	return c, ok
+}
+
+// CodecNames : names of the registered codecs, in preference order
+func CodecNames() []string {
+	codecs.m.Lock()
+	defer codecs.m.Unlock()
+	names := make([]string, len(codecs.names))
+	copy(names, codecs.names)
+	return names
+}
+
+// ChooseCodec : first codec of the dialer preferences also supported by the listener,
+// both ends of a connection compute the same result
+func ChooseCodec(dialer, listener []string) string {
+	for _, name := range dialer {
+		if _, ok := GetCodec(name); !ok {
+			continue
+		}
+		for _, other := range listener {
+			if name == other {
+				return name
+			}
+		}
+	}
+	return DefaultCodec
+}
+
+// gobCodec : gob stream, type descriptors are only sent once per connection
+type gobCodec struct{}
+
+func (gobCodec) Name() string                       { return "gob" }
+func (gobCodec) NewEncoder(w io.Writer) Encoder     { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r *bufio.Reader) Decoder { return gobDecoder{gob.NewDecoder(r)} }
+
+// gobDecoder : gob only decodes a value in its concrete type, nil drops it
+type gobDecoder struct {
+	*gob.Decoder
+}
+
+func (d gobDecoder) Skip() error {
+	var discard interface{} // nil
+	return d.Decode(discard)
+}
+
+// jsonCodec : one json document per line, readable by non-Go peers
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) NewEncoder(w io.Writer) Encoder     { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r *bufio.Reader) Decoder { return &jsonDecoder{r: r} }
+
+// jsonDecoder : json.Decoder buffers ahead, so the lines are read one by one
+type jsonDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *jsonDecoder) Decode(v interface{}) error {
+	line, err := d.r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+func (d *jsonDecoder) Skip() error {
+	_, err := d.r.ReadBytes('\n')
+	return err
+}
+
+// msgpackCodec : compact binary format
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                       { return "msgpack" }
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder     { return msgpack.NewEncoder(w) }
+func (msgpackCodec) NewDecoder(r *bufio.Reader) Decoder { return msgpack.NewDecoder(r) }
@@ -0,0 +1,37 @@
+package msg_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestCodecs : messages written with each codec are read back with their header
+func TestCodecs(t *testing.T) {
+	for _, name := range msg.CodecNames() {
+		var buf bytes.Buffer
+		w := msg.NewWriter(&buf)
+		if err := w.SetCodec(name); err != nil {
+			t.Fatal(err)
+		}
+		r := msg.NewReader(&buf)
+		for _, payload := range []string{"first", "second"} { // stateful codecs keep their state
+			sent := msg.NewEventClassic("topic", "event", payload)
+			if err := w.Send(sent.GetMsgType(), sent); err != nil {
+				t.Fatalf("%s : %s", name, err)
+			}
+			msgType, err := r.ReadHeader()
+			if err != nil || msgType != "evt" {
+				t.Fatalf("%s : bad header %q (%v)", name, msgType, err)
+			}
+			var received msg.Event
+			if err := r.ReadMessage(&received); err != nil {
+				t.Fatalf("%s : %s", name, err)
+			}
+			if received.GetUUID() != sent.GetUUID() || received.GetPayload() != payload {
+				t.Errorf("%s : message not decoded : %+v", name, received)
+			}
+		}
+	}
+}
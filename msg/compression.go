@@ -0,0 +1,177 @@
+package msg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor : compression of the frame bodies
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, maxSize int) ([]byte, error) // refuse to produce more than maxSize bytes
+}
+
+// DefaultCompressionThreshold : bodies smaller than this size are sent raw
+const DefaultCompressionThreshold = 1024
+
+// ErrDecompressedTooLarge : a compressed body expands beyond the maximum frame size
+var ErrDecompressedTooLarge = errors.New("decompressed frame too large")
+
+var compressors = struct {
+	byName map[string]Compressor
+	names  []string // preference order
+	m      sync.Mutex
+}{byName: make(map[string]Compressor)}
+
+func init() {
+	RegisterCompressor(zstdCompressor{})
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(gzipCompressor{})
+}
+
+// RegisterCompressor : make a compressor available for the negotiation, the
+// compressors registered first are preferred
+func RegisterCompressor(c Compressor) {
+	compressors.m.Lock()
+	defer compressors.m.Unlock()
+	if _, ok := compressors.byName[c.Name()]; !ok {
+		compressors.names = append(compressors.names, c.Name())
+	}
+	compressors.byName[c.Name()] = c
+}
+
+// GetCompressor : compressor registered under name
+func GetCompressor(name string) (Compressor, bool) {
+	compressors.m.Lock()
+	defer compressors.m.Unlock()
+	c, ok := compressors.byName[name]
+	return c, ok
+}
+
+// CompressorNames : names of the registered compressors, in preference order
+func CompressorNames() []string {
+	compressors.m.Lock()
+	defer compressors.m.Unlock()
+	names := make([]string, len(compressors.names))
+	copy(names, compressors.names)
+	return names
+}
+
+// ChooseCompressor : first compressor of the dialer preferences also supported
+// by the listener, "" (no compression) if there is none
+func ChooseCompressor(dialer, listener []string) string {
+	for _, name := range dialer {
+		if _, ok := GetCompressor(name); !ok {
+			continue
+		}
+		for _, other := range listener {
+			if name == other {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// readLimited : read at most maxSize bytes from r
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
+
+// gzipCompressor :
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// zstdCompressor :
+type zstdCompressor struct{}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// snappyCompressor :
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return "snappy" }
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
+
+// CompressionStats : bytes of the frame bodies before and after compression
+type CompressionStats struct {
+	RawBytes  int64
+	WireBytes int64
+}
+
+// Ratio : wire size relative to the raw size (1 when nothing was compressed)
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
@@ -9,6 +9,8 @@ type ConfigProtocol struct {
 	Address      string
 	MyBrothers   []string
 	YourBrothers []string
+	Codecs       []string // codecs supported by the sender, in preference order
+	Compressions []string // compressors supported by the sender, in preference order
 }
 
 // for link and join
@@ -0,0 +1,208 @@
+package msg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// OffsetStore : saved positions of the named consumers
+type OffsetStore interface {
+	Load(name string) (string, bool)
+	Save(name, position string) error
+}
+
+// FileOffsetStore : OffsetStore kept in a json file
+type FileOffsetStore struct {
+	path    string
+	offsets map[string]string
+	m       sync.Mutex
+}
+
+// NewFileOffsetStore : constructor, reading the positions already saved in path
+func NewFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := new(FileOffsetStore)
+	s.path = path
+	s.offsets = make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.offsets); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Load : position of the consumer name
+func (s *FileOffsetStore) Load(name string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	position, ok := s.offsets[name]
+	return position, ok
+}
+
+// Save : save the position of the consumer name (the file is replaced atomically)
+func (s *FileOffsetStore) Save(name, position string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.offsets[name] = position
+	data, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// NewNamedIterator : constructor of an iterator restoring the position saved for name
+func NewNamedIterator(queue *Queue, name string, offsets OffsetStore) *Iterator {
+	position, _ := offsets.Load(name)
+	i := NewIteratorFrom(queue, position)
+	i.name = name
+	i.offsets = offsets
+	return i
+}
+
+// Commit : save the position of a named iterator
+func (i *Iterator) Commit() error {
+	if i.offsets == nil {
+		return nil
+	}
+	return i.offsets.Save(i.name, i.GetPosition())
+}
+
+// delivery : message handed to a member and not acknowledged yet
+type delivery struct {
+	cell     Cell
+	member   string
+	deadline time.Time
+	acked    bool
+}
+
+// ConsumerGroup : consumers sharing a queue, each message being handed to only one member
+type ConsumerGroup struct {
+	name       string
+	iter       *Iterator
+	ackTimeout time.Duration
+	delivered  []*delivery // in the queue order
+	inflight   map[string]*delivery
+	offsets    OffsetStore
+	m          sync.Mutex
+}
+
+// GroupMember : consumer of a ConsumerGroup
+type GroupMember struct {
+	group *ConsumerGroup
+	name  string
+}
+
+// NewConsumerGroup : constructor, the group resumes after the last message acknowledged
+// in order when offsets is not nil ; unacknowledged messages are redelivered after ackTimeout
+func NewConsumerGroup(queue *Queue, name string, ackTimeout time.Duration, offsets OffsetStore) *ConsumerGroup {
+	g := new(ConsumerGroup)
+	g.name = name
+	g.ackTimeout = ackTimeout
+	g.inflight = make(map[string]*delivery)
+	g.offsets = offsets
+	if offsets != nil {
+		g.iter = NewNamedIterator(queue, name, offsets)
+	} else {
+		g.iter = NewIterator(queue)
+	}
+	return g
+}
+
+// Join : add a member to the group
+func (g *ConsumerGroup) Join(member string) *GroupMember {
+	return &GroupMember{group: g, name: member}
+}
+
+// Close :
+func (g *ConsumerGroup) Close() {
+	g.iter.Close()
+}
+
+// Get : next message for this member, either a message whose delivery to
+// another member was not acknowledged in time, or a message never delivered
+func (m *GroupMember) Get() *Cell {
+	g := m.group
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	now := time.Now()
+	for _, d := range g.delivered {
+		if d.acked || d.deadline.After(now) {
+			continue
+		}
+		if g.iter.queue.Get(d.cell.key) == nil { // expired or removed meanwhile
+			d.acked = true
+			delete(g.inflight, d.cell.key)
+			continue
+		}
+		d.member = m.name
+		d.deadline = now.Add(g.ackTimeout)
+		cell := d.cell
+		return &cell
+	}
+	g.commit()
+
+	cell := g.iter.Get()
+	if cell == nil {
+		return nil
+	}
+	d := &delivery{cell: *cell, member: m.name, deadline: now.Add(g.ackTimeout)}
+	g.delivered = append(g.delivered, d)
+	g.inflight[cell.key] = d
+	return cell
+}
+
+// Ack : acknowledge a message handed to this member
+func (m *GroupMember) Ack(uuid string) bool {
+	g := m.group
+	g.m.Lock()
+	defer g.m.Unlock()
+	d, ok := g.inflight[uuid]
+	if !ok || d.member != m.name {
+		return false
+	}
+	d.acked = true
+	delete(g.inflight, uuid)
+	g.commit()
+	return true
+}
+
+// Leave : the messages of this member not acknowledged yet are redelivered at once
+func (m *GroupMember) Leave() {
+	g := m.group
+	g.m.Lock()
+	defer g.m.Unlock()
+	for _, d := range g.inflight {
+		if d.member == m.name {
+			d.deadline = time.Time{}
+		}
+	}
+}
+
+// commit : forget the acknowledged messages at the head of the deliveries and
+// save the position of the last of them (group lock held)
+func (g *ConsumerGroup) commit() {
+	n := 0
+	for n < len(g.delivered) && g.delivered[n].acked {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	last := g.delivered[n-1].cell.key
+	g.delivered = g.delivered[n:]
+	if g.offsets != nil {
+		g.offsets.Save(g.name, last)
+	}
+}
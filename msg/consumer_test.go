@@ -0,0 +1,44 @@
+package msg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestConsumerGroup : each message goes to one member and is redelivered when not acknowledged
+func TestConsumerGroup(t *testing.T) {
+	q := msg.NewQueue()
+	defer q.Close()
+	e1 := msg.NewEventClassic("topic", "e1", "")
+	e2 := msg.NewEventClassic("topic", "e2", "")
+	q.Push(*e1, "c", "localhost:8001")
+	q.Push(*e2, "c", "localhost:8001")
+
+	group := msg.NewConsumerGroup(q, "workers", 20*time.Millisecond, nil)
+	defer group.Close()
+	m1 := group.Join("m1")
+	m2 := group.Join("m2")
+
+	c1 := m1.Get()
+	c2 := m2.Get()
+	if c1 == nil || c2 == nil || c1.GetMessage().GetUUID() == c2.GetMessage().GetUUID() {
+		t.Fatal("members should receive distinct messages")
+	}
+	if m1.Get() != nil {
+		t.Fatal("no message should be left")
+	}
+	if !m1.Ack(c1.GetMessage().GetUUID()) {
+		t.Error("m1 should acknowledge its message")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	redelivered := m1.Get()
+	if redelivered == nil || redelivered.GetMessage().GetUUID() != c2.GetMessage().GetUUID() {
+		t.Fatal("the message not acknowledged by m2 should be redelivered")
+	}
+	if m2.Ack(c2.GetMessage().GetUUID()) {
+		t.Error("m2 should not acknowledge a message redelivered to m1")
+	}
+}
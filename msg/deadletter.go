@@ -0,0 +1,49 @@
+package msg
+
+import "time"
+
+// Reasons of the dead letters
+const (
+	DeadLetterHandlerFailed = "handler"     // the handler of the message returned an error
+	DeadLetterNoRoute       = "noroute"     // no handler for the type of the message
+	DeadLetterExpired       = "expired"     // the message expired in its queue without being consumed
+	DeadLetterDecodeFailed  = "decode"      // the message could not be decoded
+	DeadLetterUndelivered   = "undelivered" // the message sent with QoSAtLeastOnce was never acknowledged
+	DeadLetterRateLimited   = "ratelimited" // the message was dropped by a rate limit of its receiver
+)
+
+// DeadLetter : message which could not be delivered, kept in the dead-letter queue of a shoset
+type DeadLetter struct {
+	MessageBase
+	Message           Message // undecoded messages are kept as Unknown
+	Reason            string
+	Error             string
+	RemoteAddress     string // source connection
+	RemoteLogicalName string
+	RemoteShosetType  string
+	ReceivedAt        int64 // unix time in nanoseconds
+	FailedAt          int64
+}
+
+// NewDeadLetter : DeadLetter constructor, retained for the given duration
+func NewDeadLetter(m Message, reason string, err error, retention time.Duration) *DeadLetter {
+	d := new(DeadLetter)
+	d.InitMessageBase()
+	d.Timeout = int64(retention / time.Millisecond)
+	d.Message = m
+	d.Reason = reason
+	if err != nil {
+		d.Error = err.Error()
+	}
+	d.FailedAt = time.Now().UnixNano()
+	return d
+}
+
+// GetMsgType accessor
+func (d DeadLetter) GetMsgType() string { return "dlq" }
+
+// GetMessage : the undelivered message
+func (d DeadLetter) GetMessage() Message { return d.Message }
+
+// GetReason accessor
+func (d DeadLetter) GetReason() string { return d.Reason }
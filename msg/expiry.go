@@ -0,0 +1,104 @@
+package msg
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryItem : deadline of a message in the queue
+type expiryItem struct {
+	key      string
+	deadline time.Time
+	index    int
+}
+
+// expiryHeap : min-heap of the queue deadlines, the earliest first
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// expirer : single timer removing the expired messages of a queue, its goroutine only
+// runs while messages are waiting for their deadline
+type expirer struct {
+	items   expiryHeap
+	byKey   map[string]*expiryItem
+	running bool // expiry goroutine
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+func newExpirer() *expirer {
+	e := new(expirer)
+	e.byKey = make(map[string]*expiryItem)
+	e.wake = make(chan struct{}, 1)
+	e.stop = make(chan struct{})
+	return e
+}
+
+// add : schedule the expiry of key (queue lock held)
+func (e *expirer) add(key string, deadline time.Time) {
+	item := &expiryItem{key: key, deadline: deadline}
+	heap.Push(&e.items, item)
+	e.byKey[key] = item
+	if item.index == 0 { // new earliest deadline
+		e.signal()
+	}
+}
+
+// cancel : unschedule the expiry of key (queue lock held)
+func (e *expirer) cancel(key string) {
+	item, ok := e.byKey[key]
+	if !ok {
+		return
+	}
+	delete(e.byKey, key)
+	heap.Remove(&e.items, item.index)
+}
+
+// expired : pop the keys whose deadline is over (queue lock held)
+func (e *expirer) expired(now time.Time) []string {
+	var keys []string
+	for len(e.items) > 0 && !e.items[0].deadline.After(now) {
+		item := heap.Pop(&e.items).(*expiryItem)
+		delete(e.byKey, item.key)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+// next : delay before the earliest deadline (queue lock held)
+func (e *expirer) next(now time.Time) (time.Duration, bool) {
+	if len(e.items) == 0 {
+		return 0, false
+	}
+	return e.items[0].deadline.Sub(now), true
+}
+
+func (e *expirer) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,206 @@
+package msg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame layout :
+//
+//	magic   2 bytes  "SH"
+//	version 1 byte   ProtocolVersion
+//	flags   1 byte   see flagStreamReset, flagCompressed, flagAttempt and flagSequenced
+//	codec   1 byte length + name
+//	type    1 byte length + name
+//	compr   1 byte length + name, only with flagCompressed
+//	attempt 2 uvarints, attempt and max attempts, only with flagAttempt
+//	seq     2 uvarints, sequence number and low mark, only with flagSequenced
+//	length  4 bytes  big endian length of the body (compressed)
+//	body    encoded message
+var frameMagic = [2]byte{'S', 'H'}
+
+// ProtocolVersion : version of the frame layout
+const ProtocolVersion = 1
+
+// DefaultMaxFrameSize : largest body accepted by default
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+// flagStreamReset : the body starts a new stream of its codec, the receiver
+// must forget the state of its decoder (e.g. the gob type descriptors)
+const flagStreamReset byte = 1
+
+// flagCompressed : the body is compressed with the compressor named in the header
+const flagCompressed byte = 2
+
+// flagAttempt : the header holds the attempt of a message sent with QoSAtLeastOnce
+const flagAttempt byte = 4
+
+// flagSequenced : the header holds the sequence number of the message on its connection
+const flagSequenced byte = 8
+
+// FrameMeta : delivery information carried by the header of a frame besides its message
+type FrameMeta struct {
+	Attempt     int    // sending of the message, from 1, 0 when unknown
+	MaxAttempts int    // sendings of the message before its sender gives up
+	Seq         uint64 // order in which the message was sent on its connection, from 1, 0 when unknown
+	Low         uint64 // lowest sequence number not written yet by the sender, the lower ones never come
+}
+
+// LastAttempt : the sender will not send the message again
+func (m FrameMeta) LastAttempt() bool {
+	return m.Attempt == 0 || m.Attempt >= m.MaxAttempts
+}
+
+// ErrFrameTooLarge : the body announced by a frame exceeds the maximum frame size
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// frameHeader : header of a frame
+type frameHeader struct {
+	version     byte
+	flags       byte
+	codec       string
+	msgType     string
+	compression string
+	meta        FrameMeta
+	length      uint32
+}
+
+// writeFrame : write a frame (header and body)
+func writeFrame(w *bufio.Writer, h frameHeader, body []byte) error {
+	if len(h.codec) > 255 || len(h.msgType) > 255 || len(h.compression) > 255 {
+		return errors.New("writeFrame : codec, message type or compression name too long")
+	}
+	header := make([]byte, 0, 11+len(h.codec)+len(h.msgType)+len(h.compression))
+	header = append(header, frameMagic[0], frameMagic[1], ProtocolVersion, h.flags)
+	header = append(header, byte(len(h.codec)))
+	header = append(header, h.codec...)
+	header = append(header, byte(len(h.msgType)))
+	header = append(header, h.msgType...)
+	if h.flags&flagCompressed != 0 {
+		header = append(header, byte(len(h.compression)))
+		header = append(header, h.compression...)
+	}
+	if h.flags&flagAttempt != 0 {
+		header = appendUvarints(header, uint64(h.meta.Attempt), uint64(h.meta.MaxAttempts))
+	}
+	if h.flags&flagSequenced != 0 {
+		header = appendUvarints(header, h.meta.Seq, h.meta.Low)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)))
+	header = append(header, length[:]...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readFrameHeader : read the next frame header, skipping the bytes preceding
+// the magic (at most maxSize) to resynchronize after a corrupted frame
+func readFrameHeader(r *bufio.Reader, maxSize int) (frameHeader, error) {
+	var h frameHeader
+	skipped := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return h, err
+		}
+		if b == frameMagic[0] {
+			next, err := r.Peek(1)
+			if err != nil {
+				return h, err
+			}
+			if next[0] == frameMagic[1] {
+				r.ReadByte()
+				break
+			}
+		}
+		skipped++
+		if skipped > maxSize {
+			return h, errors.New("readFrameHeader : no frame found")
+		}
+	}
+
+	fixed := make([]byte, 2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return h, err
+	}
+	h.version, h.flags = fixed[0], fixed[1]
+	if h.version != ProtocolVersion {
+		return h, fmt.Errorf("readFrameHeader : unsupported protocol version %d", h.version)
+	}
+	var err error
+	if h.codec, err = readShortString(r); err != nil {
+		return h, err
+	}
+	if h.msgType, err = readShortString(r); err != nil {
+		return h, err
+	}
+	if h.flags&flagCompressed != 0 {
+		if h.compression, err = readShortString(r); err != nil {
+			return h, err
+		}
+	}
+	if h.flags&flagAttempt != 0 {
+		values, err := readUvarints(r, 2)
+		if err != nil {
+			return h, err
+		}
+		h.meta.Attempt, h.meta.MaxAttempts = int(values[0]), int(values[1])
+	}
+	if h.flags&flagSequenced != 0 {
+		values, err := readUvarints(r, 2)
+		if err != nil {
+			return h, err
+		}
+		h.meta.Seq, h.meta.Low = values[0], values[1]
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return h, err
+	}
+	h.length = binary.BigEndian.Uint32(length[:])
+	if maxSize > 0 && int64(h.length) > int64(maxSize) {
+		return h, ErrFrameTooLarge
+	}
+	return h, nil
+}
+
+// readShortString : string prefixed by its length on one byte
+func readShortString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// appendUvarints : append values encoded as uvarints
+func appendUvarints(b []byte, values ...uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	for _, v := range values {
+		b = append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	return b
+}
+
+// readUvarints : read n values encoded as uvarints
+func readUvarints(r *bufio.Reader, n int) ([]uint64, error) {
+	values := make([]uint64, n)
+	for i := range values {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,128 @@
+package msg_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestFrameTooLarge : a frame bigger than the maximum size is refused before its body is read
+func TestFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w := msg.NewWriter(&buf)
+	big := msg.NewEventClassic("topic", "event", strings.Repeat("x", 4096))
+	if err := w.Send(big.GetMsgType(), big); err != nil {
+		t.Fatal(err)
+	}
+	r := msg.NewReader(&buf)
+	r.SetMaxFrameSize(1024)
+	if _, err := r.ReadHeader(); err != msg.ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+
+	w.SetMaxFrameSize(1024)
+	if err := w.Send(big.GetMsgType(), big); err != msg.ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge on send, got %v", err)
+	}
+}
+
+// TestFrameResync : the reader skips garbage preceding a frame
+func TestFrameResync(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("garbage\n")
+	w := msg.NewWriter(&buf)
+	sent := msg.NewEventClassic("topic", "event", "payload")
+	w.Send(sent.GetMsgType(), sent)
+
+	r := msg.NewReader(&buf)
+	msgType, err := r.ReadHeader()
+	if err != nil || msgType != "evt" {
+		t.Fatalf("bad header %q (%v)", msgType, err)
+	}
+	var received msg.Event
+	if err := r.ReadMessage(&received); err != nil || received.GetUUID() != sent.GetUUID() {
+		t.Errorf("message not decoded after resync : %v", err)
+	}
+}
+
+// TestFrameCompression : bodies above the threshold are compressed and transparently decompressed
+func TestFrameCompression(t *testing.T) {
+	for _, name := range msg.CompressorNames() {
+		var buf bytes.Buffer
+		w := msg.NewWriter(&buf)
+		w.SetCompression(name, 512)
+		r := msg.NewReader(&buf)
+		for _, payload := range []string{"small", strings.Repeat("{\"key\": \"value\"}", 512)} {
+			sent := msg.NewEventClassic("topic", "event", payload)
+			if err := w.Send(sent.GetMsgType(), sent); err != nil {
+				t.Fatalf("%s : %s", name, err)
+			}
+			r.ReadHeader()
+			var received msg.Event
+			if err := r.ReadMessage(&received); err != nil || received.GetPayload() != payload {
+				t.Fatalf("%s : message not decoded (%v)", name, err)
+			}
+		}
+		if ratio := w.GetStats().Ratio(); ratio >= 0.5 {
+			t.Errorf("%s : poor compression ratio %f", name, ratio)
+		}
+		if r.GetStats() != w.GetStats() {
+			t.Errorf("%s : sent and received stats differ", name)
+		}
+	}
+}
+
+// TestSkipMessage : a message of an unknown type is skipped without breaking the decoding stream
+func TestSkipMessage(t *testing.T) {
+	for _, name := range msg.CodecNames() {
+		var buf bytes.Buffer
+		w := msg.NewWriter(&buf)
+		w.SetCodec(name)
+		unknown := msg.NewCommand("target", "command", "payload")
+		w.Send("newtype", unknown)
+		sent := msg.NewEventClassic("topic", "event", "payload")
+		w.Send(sent.GetMsgType(), sent)
+
+		r := msg.NewReader(&buf)
+		if msgType, err := r.ReadHeader(); err != nil || msgType != "newtype" {
+			t.Fatalf("%s : bad header %q (%v)", name, msgType, err)
+		}
+		skipped, err := r.SkipMessage()
+		if err != nil || skipped.GetMsgType() != "newtype" || skipped.Codec != name || len(skipped.Body) == 0 {
+			t.Fatalf("%s : message not skipped : %v", name, err)
+		}
+		if msgType, err := r.ReadHeader(); err != nil || msgType != "evt" {
+			t.Fatalf("%s : bad header %q (%v)", name, msgType, err)
+		}
+		var received msg.Event
+		if err := r.ReadMessage(&received); err != nil || received.GetUUID() != sent.GetUUID() {
+			t.Errorf("%s : message not decoded after a skipped one : %v", name, err)
+		}
+	}
+}
+
+// TestFrameMeta : the attempt and the sequence number of a message are read back from its frame, the other frames have none
+func TestFrameMeta(t *testing.T) {
+	var buf bytes.Buffer
+	w := msg.NewWriter(&buf)
+	w.SetCompression(msg.CompressorNames()[0], 0)
+	sent := msg.NewEventClassic("topic", "event", "payload")
+	w.SendMeta(sent.GetMsgType(), sent, msg.FrameMeta{Attempt: 3, MaxAttempts: 300, Seq: 1 << 40, Low: 7})
+	w.Send(sent.GetMsgType(), sent)
+
+	r := msg.NewReader(&buf)
+	for _, expected := range []msg.FrameMeta{{Attempt: 3, MaxAttempts: 300, Seq: 1 << 40, Low: 7}, {}} {
+		if _, err := r.ReadHeader(); err != nil {
+			t.Fatal(err)
+		}
+		if meta := r.GetMeta(); meta != expected {
+			t.Errorf("expected %+v, got %+v", expected, meta)
+		}
+		var received msg.Event
+		if err := r.ReadMessage(&received); err != nil || received.GetPayload() != "payload" {
+			t.Errorf("message not decoded after the meta : %v", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package msg
+
+import "sort"
+
+// index : UUIDs of the queued messages by value of one of their fields
+type index map[string]map[string]bool
+
+func (x index) add(value, key string) {
+	if value == "" {
+		return
+	}
+	if x[value] == nil {
+		x[value] = make(map[string]bool)
+	}
+	x[value][key] = true
+}
+
+func (x index) remove(value, key string) {
+	if keys := x[value]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(x, value)
+		}
+	}
+}
+
+// queueIndexes : secondary indexes maintained by a Queue
+type queueIndexes struct {
+	byReference  index
+	byTopic      index
+	byCommand    index
+	byRemoteType index
+}
+
+func newQueueIndexes() *queueIndexes {
+	return &queueIndexes{
+		byReference:  make(index),
+		byTopic:      make(index),
+		byCommand:    make(index),
+		byRemoteType: make(index),
+	}
+}
+
+// commandName : command of the message if it has one
+func commandName(m Message) string {
+	switch v := m.(type) {
+	case interface{ GetCommand() string }:
+		return v.GetCommand()
+	case interface{ GetCommandName() string }:
+		return v.GetCommandName()
+	}
+	return ""
+}
+
+func (x *queueIndexes) add(c Cell) {
+	if v, ok := c.m.(interface{ GetReferenceUUID() string }); ok {
+		x.byReference.add(v.GetReferenceUUID(), c.key)
+	}
+	if v, ok := c.m.(interface{ GetTopic() string }); ok {
+		x.byTopic.add(v.GetTopic(), c.key)
+	}
+	x.byCommand.add(commandName(c.m), c.key)
+	x.byRemoteType.add(c.RemoteShosetType, c.key)
+}
+
+func (x *queueIndexes) remove(c Cell) {
+	if v, ok := c.m.(interface{ GetReferenceUUID() string }); ok {
+		x.byReference.remove(v.GetReferenceUUID(), c.key)
+	}
+	if v, ok := c.m.(interface{ GetTopic() string }); ok {
+		x.byTopic.remove(v.GetTopic(), c.key)
+	}
+	x.byCommand.remove(commandName(c.m), c.key)
+	x.byRemoteType.remove(c.RemoteShosetType, c.key)
+}
+
+// lookup : cells of the keys indexed under value, oldest first (queue lock held)
+func (q *Queue) lookup(x index, value string) []*Cell {
+	var cells []*Cell
+	for key := range x[value] {
+		if ele := q.dict[key]; ele != nil {
+			cell := ele.Value.(Cell)
+			cells = append(cells, &cell)
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].seq < cells[j].seq })
+	return cells
+}
+
+// GetByReferencesUUID : oldest event replying to the message uuid
+func (q *Queue) GetByReferencesUUID(uuid string) *Event {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, cell := range q.lookup(q.indexes.byReference, uuid) {
+		if event, ok := cell.m.(Event); ok {
+			return &event
+		}
+	}
+	return nil
+}
+
+// GetByTopic : messages of a topic, oldest first
+func (q *Queue) GetByTopic(topic string) []*Cell {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.lookup(q.indexes.byTopic, topic)
+}
+
+// GetByCommand : messages of a command, oldest first
+func (q *Queue) GetByCommand(command string) []*Cell {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.lookup(q.indexes.byCommand, command)
+}
+
+// GetByRemoteShosetType : messages received from a type of shoset, oldest first
+func (q *Queue) GetByRemoteShosetType(shosetType string) []*Cell {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.lookup(q.indexes.byRemoteType, shosetType)
+}
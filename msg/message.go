@@ -15,10 +15,29 @@ type Message interface {
 	GetTimestamp() int64
 	GetTimeout() int64
 	GetPayload() string
+	GetPayloadBytes() []byte
+	GetContentType() string
 	GetMajor() int8
 	GetMinor() int8
+	GetQoS() int8
+	GetClock() int64
+	GetPriority() int8
 }
 
+// Delivery guarantees of the messages, see MessageBase.QoS
+const (
+	QoSAtMostOnce  int8 = iota // sent once, lost with a failing connection
+	QoSAtLeastOnce             // sent again until the receiver acknowledges it, once its handler succeeded
+)
+
+// Outbound priorities of the messages, see MessageBase.Priority ; the control messages
+// (configuration, acknowledgements) are always written before them
+const (
+	PriorityLow    int8 = -1
+	PriorityNormal int8 = 0 // default
+	PriorityHigh   int8 = 1
+)
+
 // MessageBase base struct for messages
 type MessageBase struct {
 	UUID      string
@@ -30,12 +49,22 @@ type MessageBase struct {
 	Next      string
 	Major     int8
 	Minor     int8
+
+	PayloadBytes []byte // binary payload, see SetPayloadBytes
+	ContentType  string // content type of the payload, empty for legacy text payloads
+
+	QoS int8 // delivery guarantee, QoSAtMostOnce by default
+
+	Clock int64 // hybrid logical clock of the creation, in nanoseconds
+
+	Priority int8 // outbound priority, the higher first, PriorityNormal by default
 }
 
 // InitMessageBase constructor
 func (m *MessageBase) InitMessageBase() {
 	m.UUID = uuid.New()
-	m.Timestamp = time.Now().Unix()
+	m.Clock = ClockNow()
+	m.Timestamp = m.Clock / int64(time.Second)
 	m.Timeout = 1000
 	m.Major = 1
 	m.Minor = 0
@@ -80,3 +109,18 @@ func (m MessageBase) GetMajor() int8 {
 func (m MessageBase) GetMinor() int8 {
 	return m.Minor
 }
+
+// GetQoS accessor
+func (m MessageBase) GetQoS() int8 {
+	return m.QoS
+}
+
+// GetClock accessor
+func (m MessageBase) GetClock() int64 {
+	return m.Clock
+}
+
+// GetPriority accessor
+func (m MessageBase) GetPriority() int8 {
+	return m.Priority
+}
@@ -0,0 +1,91 @@
+package msg
+
+import "errors"
+
+// OverflowPolicy : behaviour of a bounded queue when it is full
+type OverflowPolicy int
+
+const (
+	// DropOldest : the oldest messages are removed to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest : the new message is discarded
+	DropNewest
+	// Block : the producer waits until there is room in the queue
+	Block
+	// Reject : the new message is refused with ErrQueueFull
+	Reject
+)
+
+var (
+	// ErrMessageExists : a message with the same UUID is already in the queue
+	ErrMessageExists = errors.New("message already in queue")
+	// ErrMessageDropped : the message was discarded by the DropNewest policy
+	ErrMessageDropped = errors.New("queue full : message dropped")
+	// ErrQueueFull : the message was refused by the Reject policy
+	ErrQueueFull = errors.New("queue full : message rejected")
+	// ErrQueueClosed : the queue was closed while the producer was waiting
+	ErrQueueClosed = errors.New("queue closed")
+)
+
+// QueueOptions : capacity of a queue, zero values meaning unlimited
+type QueueOptions struct {
+	MaxCount int // maximum number of messages
+	MaxBytes int // maximum size of the messages (see MessageSize)
+	Policy   OverflowPolicy
+}
+
+// MessageSize : approximate size in bytes of a message, used for the queue capacity
+func MessageSize(m Message) int {
+	payload := len(m.GetPayload())
+	if payload == 0 {
+		payload = len(m.GetPayloadBytes())
+	}
+	return len(m.GetUUID()) + len(m.GetTenant()) + len(m.GetToken()) + payload + 32
+}
+
+// isFull : adding size bytes would exceed the capacity (queue lock held)
+func (q *Queue) isFull(size int) bool {
+	count := q.qlist.Len()
+	if q.opts.MaxCount > 0 && count >= q.opts.MaxCount {
+		return true
+	}
+	// a message bigger than the queue is accepted in an empty queue
+	return q.opts.MaxBytes > 0 && count > 0 && q.bytes+size > q.opts.MaxBytes
+}
+
+// makeRoom : apply the overflow policy until size bytes fit in the queue (queue lock held)
+func (q *Queue) makeRoom(size int) ([]Cell, error) {
+	var dropped []Cell
+	for q.isFull(size) {
+		switch q.opts.Policy {
+		case DropOldest:
+			oldest := q.qlist.Back().Value.(Cell)
+			if cell, ok := q.remove(oldest.key); ok {
+				dropped = append(dropped, cell)
+				if q.store != nil {
+					q.store.Delete(cell.key)
+				}
+			}
+		case DropNewest:
+			return dropped, ErrMessageDropped
+		case Reject:
+			return dropped, ErrQueueFull
+		case Block:
+			if q.closed {
+				return dropped, ErrQueueClosed
+			}
+			q.notFull.Wait()
+		}
+	}
+	return dropped, nil
+}
+
+// WaitNotFull : block while a queue with the Block policy is full, so that the
+// caller (the connection read loop) stops consuming and the sender is slowed down
+func (q *Queue) WaitNotFull() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for q.opts.Policy == Block && !q.closed && q.isFull(0) {
+		q.notFull.Wait()
+	}
+}
@@ -0,0 +1,67 @@
+package msg
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Content types of the payloads
+const (
+	ContentTypeText   = "text/plain"
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Validator : payload checking its own content once decoded by GetPayloadJSON
+type Validator interface {
+	Validate() error
+}
+
+// SetPayloadBytes : binary payload, replacing the string payload
+func (m *MessageBase) SetPayloadBytes(data []byte, contentType string) {
+	if contentType == "" {
+		contentType = ContentTypeBinary
+	}
+	m.Payload = ""
+	m.PayloadBytes = data
+	m.ContentType = contentType
+}
+
+// GetPayloadBytes : binary payload, or the string payload as bytes
+func (m MessageBase) GetPayloadBytes() []byte {
+	if m.PayloadBytes != nil {
+		return m.PayloadBytes
+	}
+	return []byte(m.Payload)
+}
+
+// GetContentType accessor
+func (m MessageBase) GetContentType() string {
+	return m.ContentType
+}
+
+// SetPayloadJSON : json encoded payload
+func (m *MessageBase) SetPayloadJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Payload = string(data)
+	m.PayloadBytes = nil
+	m.ContentType = ContentTypeJSON
+	return nil
+}
+
+// GetPayloadJSON : decode a json payload in v, then validate it if v is a Validator
+func (m MessageBase) GetPayloadJSON(v interface{}) error {
+	if m.ContentType != "" && m.ContentType != ContentTypeJSON {
+		return errors.New("GetPayloadJSON : payload content type is " + m.ContentType)
+	}
+	if err := json.Unmarshal(m.GetPayloadBytes(), v); err != nil {
+		return err
+	}
+	if validator, ok := v.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package msg_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+type deployment struct {
+	Appli string `json:"appli"`
+}
+
+func (d *deployment) Validate() error {
+	if d.Appli == "" {
+		return errors.New("missing appli")
+	}
+	return nil
+}
+
+// TestPayloads : binary and json payloads go through every codec
+func TestPayloads(t *testing.T) {
+	for _, name := range msg.CodecNames() {
+		var buf bytes.Buffer
+		w := msg.NewWriter(&buf)
+		w.SetCodec(name)
+		r := msg.NewReader(&buf)
+
+		binary := msg.NewCommand("target", "upload", "")
+		binary.SetPayloadBytes([]byte{0, 1, 2, 255}, "")
+		structured := msg.NewCommand("target", "deploy", "")
+		structured.SetPayloadJSON(deployment{Appli: "toto"})
+		for _, sent := range []*msg.Command{binary, structured} {
+			w.Send(sent.GetMsgType(), sent)
+			r.ReadHeader()
+			var received msg.Command
+			if err := r.ReadMessage(&received); err != nil {
+				t.Fatalf("%s : %s", name, err)
+			}
+			if !bytes.Equal(received.GetPayloadBytes(), sent.GetPayloadBytes()) || received.GetContentType() != sent.GetContentType() {
+				t.Errorf("%s : payload not decoded : %+v", name, received)
+			}
+		}
+	}
+
+	var d deployment
+	invalid := msg.NewCommand("target", "deploy", "")
+	invalid.SetPayloadJSON(deployment{})
+	if err := invalid.GetPayloadJSON(&d); err == nil {
+		t.Error("invalid payload should not be validated")
+	}
+}
@@ -9,10 +9,20 @@ import (
 
 //Queue : queue allowing access via a string key
 type Queue struct {
-	qlist list.List
-	dict  map[string]*list.Element
-	iters map[*Iterator]bool
-	m     sync.Mutex
+	qlist    list.List
+	dict     map[string]*list.Element
+	iters    map[*Iterator]bool
+	exp      *expirer
+	onExpire []func(*Cell)
+	onDrop   []func(*Cell)
+	opts     QueueOptions
+	bytes    int
+	notFull  *sync.Cond
+	closed   bool
+	store    Store
+	seq      uint64
+	indexes  *queueIndexes
+	m        sync.Mutex
 }
 
 // Cell : witch contain messages and useful intel
@@ -21,12 +31,24 @@ type Cell struct {
 	timeout          int64
 	RemoteShosetType string
 	RemoteAddress    string
+	size             int
+	seq              uint64
+	deadline         time.Time
+	read             bool // returned by an iterator
 	m                Message
 }
 
 // GetMessage :
 func (c *Cell) GetMessage() Message { return c.m }
 
+// WasRead : the message was returned by an iterator of the queue
+func (c *Cell) WasRead() bool { return c.read }
+
+// GetQueuedAt : time the message was put in the queue
+func (c *Cell) GetQueuedAt() time.Time {
+	return c.deadline.Add(-time.Duration(c.timeout) * time.Millisecond)
+}
+
 // NewQueue : constructor
 func NewQueue() *Queue {
 	q := new(Queue)
@@ -34,29 +56,95 @@ func NewQueue() *Queue {
 	return q
 }
 
+// NewQueueWithOptions : constructor of a bounded queue
+func NewQueueWithOptions(opts QueueOptions) *Queue {
+	q := NewQueue()
+	q.opts = opts
+	return q
+}
+
+// NewPersistentQueue : constructor of a queue saved in store, reloading the messages still alive
+func NewPersistentQueue(store Store, opts QueueOptions) (*Queue, error) {
+	cells, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	q := NewQueueWithOptions(opts)
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.store = store
+	for _, c := range cells {
+		q.dict[c.key] = q.qlist.PushFront(c)
+		q.indexes.add(c)
+		q.bytes += c.size
+		q.expireAt(c.key, c.deadline)
+	}
+	q.seq = store.LastSeq() // removed messages included : their numbers are never given again
+	return q, nil
+}
+
 // Init :
 func (q *Queue) Init() {
 	q.qlist.Init()
 	q.dict = make(map[string]*list.Element)
 	q.iters = make(map[*Iterator]bool)
+	q.exp = newExpirer()
+	q.indexes = newQueueIndexes()
+	q.notFull = sync.NewCond(&q.m)
 }
 
-// Init :
-func (q *Queue) GetByReferencesUUID(uuid string) *Event {
-	//q.m.Lock()
-	//defer q.m.Unlock()
-	for _, val := range q.dict {
-		value := val.Value.(Cell).m.(Event)
-		if uuid == value.GetReferenceUUID() {
-			return &value
-		}
+// Close : stop the expiry of the messages of the queue and close its store
+func (q *Queue) Close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	select {
+	case <-q.exp.stop:
+	default:
+		close(q.exp.stop)
 	}
+	q.closed = true
+	q.notFull.Broadcast()
+	if q.store != nil {
+		q.store.Close()
+	}
+}
 
-	return nil
+// SetOptions : change the capacity and the overflow policy of the queue
+func (q *Queue) SetOptions(opts QueueOptions) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.opts = opts
+	q.notFull.Broadcast()
+}
+
+// GetOptions :
+func (q *Queue) GetOptions() QueueOptions {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.opts
+}
+
+// OnExpire : register a callback called with each message removed after its timeout
+func (q *Queue) OnExpire(f func(*Cell)) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.onExpire = append(q.onExpire, f)
+}
+
+// OnDrop : register a callback called with each message removed by the DropOldest policy
+func (q *Queue) OnDrop(f func(*Cell)) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.onDrop = append(q.onDrop, f)
 }
 
 // Push : insert a new value in the queue except if the UUID is already present and remove after timeout expiration
 func (q *Queue) Push(m Message, RemoteShosetType, RemoteAddress string) bool {
+	return q.Put(m, RemoteShosetType, RemoteAddress) == nil
+}
+
+// Put : same as Push but report why the message was not inserted
+func (q *Queue) Put(m Message, RemoteShosetType, RemoteAddress string) error {
 	fmt.Printf("Push a message!\n")
 
 	// Let's first initialize the Cell with all our data
@@ -67,40 +155,92 @@ func (q *Queue) Push(m Message, RemoteShosetType, RemoteAddress string) bool {
 	c.timeout = m.GetTimeout()
 	c.RemoteShosetType = RemoteShosetType
 	c.RemoteAddress = RemoteAddress
+	c.size = MessageSize(m)
+	c.deadline = time.Now().Add(time.Duration(c.timeout) * time.Millisecond)
 	c.m = m
 
 	q.m.Lock()
-	defer q.m.Unlock()
 	ele := q.dict[c.key]
 	if ele != nil {
-		return false
+		q.m.Unlock()
+		return ErrMessageExists
+	}
+
+	dropped, err := q.makeRoom(c.size)
+	if err == nil && q.dict[c.key] != nil { // may have been pushed while blocked
+		err = ErrMessageExists
+	}
+	if err == nil {
+		c.seq = q.seq + 1
+		if q.store != nil {
+			err = q.store.Append(c)
+		}
 	}
+	if err == nil {
+		q.seq = c.seq
+		ele = q.qlist.PushFront(c)
+		q.dict[c.key] = ele
+		q.indexes.add(c)
+		q.bytes += c.size
+		q.expireAt(c.key, c.deadline)
+	}
+	callbacks := q.onDrop
+	q.m.Unlock()
 
-	ele = q.qlist.PushFront(c)
-	q.dict[c.key] = ele
-	go func() {
-		time.Sleep(time.Duration(c.timeout) * time.Millisecond)
-		q.remove(c.key)
-	}()
-	return true
+	for i := range dropped {
+		for _, f := range callbacks {
+			f(&dropped[i])
+		}
+	}
+	return err
 }
 
-// First :
-func (q *Queue) First() *Cell {
+// Get : cell of the message with the given UUID, nil if it is not in the queue
+func (q *Queue) Get(key string) *Cell {
 	q.m.Lock()
 	defer q.m.Unlock()
-	ele := q.qlist.Back()
-	if ele != nil {
+	if ele := q.dict[key]; ele != nil {
 		value := ele.Value.(Cell)
 		return &value
 	}
 	return nil
 }
 
+// First :
+func (q *Queue) First() *Cell {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.first()
+}
+
 // Next :
 func (q *Queue) Next(key string) *Cell {
 	q.m.Lock()
 	defer q.m.Unlock()
+	return q.next(key)
+}
+
+// first : (queue lock held)
+func (q *Queue) first() *Cell {
+	ele := q.qlist.Back()
+	if ele != nil {
+		value := ele.Value.(Cell)
+		return &value
+	}
+	return nil
+}
+
+// markRead : record that a message was returned by an iterator (queue lock held)
+func (q *Queue) markRead(key string) {
+	if ele := q.dict[key]; ele != nil {
+		cell := ele.Value.(Cell)
+		cell.read = true
+		ele.Value = cell
+	}
+}
+
+// next : (queue lock held)
+func (q *Queue) next(key string) *Cell {
 	cellFromKey := q.dict[key]
 	if cellFromKey != nil {
 		nextEle := cellFromKey.Prev()
@@ -112,40 +252,140 @@ func (q *Queue) Next(key string) *Cell {
 	return nil
 }
 
-// remove :
-func (q *Queue) remove(key string) {
+// Remove : remove the message with the given UUID before its timeout
+func (q *Queue) Remove(key string) bool {
 	q.m.Lock()
 	defer q.m.Unlock()
+	_, ok := q.remove(key)
+	if ok && q.store != nil {
+		q.store.Delete(key)
+	}
+	return ok
+}
+
+// Replay : call f for every message pushed since timestamp from (in seconds), oldest first,
+// including the removed and expired ones when the queue is persistent ; stop when f returns false
+func (q *Queue) Replay(from int64, f func(*Cell) bool) error {
+	q.m.Lock()
+	store := q.store
+	var cells []Cell
+	if store == nil {
+		for ele := q.qlist.Back(); ele != nil; ele = ele.Prev() {
+			if cell := ele.Value.(Cell); cell.m.GetTimestamp() >= from {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	q.m.Unlock()
+
+	if store != nil {
+		return store.Replay(from, func(cell Cell) bool { return f(&cell) })
+	}
+	for i := range cells {
+		if !f(&cells[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// seek : key of the newest queued message pushed before or as key (queue lock held)
+func (q *Queue) seek(key string) string {
+	if q.dict[key] != nil {
+		return key
+	}
+	if q.store == nil {
+		return ""
+	}
+	seq, ok := q.store.Seq(key)
+	if !ok {
+		return ""
+	}
+	for ele := q.qlist.Front(); ele != nil; ele = ele.Next() {
+		if cell := ele.Value.(Cell); cell.seq <= seq {
+			return cell.key
+		}
+	}
+	return ""
+}
+
+// expireAt : schedule the expiry of key, starting the expiry goroutine if needed (queue lock held)
+func (q *Queue) expireAt(key string, deadline time.Time) {
+	q.exp.add(key, deadline)
+	if !q.exp.running && !q.closed {
+		q.exp.running = true
+		go q.runExpiry()
+	}
+}
+
+// runExpiry : remove the messages of the queue when their timeout expires, until no message is left to expire
+func (q *Queue) runExpiry() {
+	for {
+		q.m.Lock()
+		var expired []Cell
+		for _, key := range q.exp.expired(time.Now()) {
+			if cell, ok := q.remove(key); ok {
+				expired = append(expired, cell)
+			}
+		}
+		callbacks := q.onExpire
+		delay, ok := q.exp.next(time.Now())
+		if !ok {
+			q.exp.running = false // started again by the next message
+		}
+		q.m.Unlock()
+
+		for i := range expired {
+			for _, f := range callbacks {
+				f(&expired[i])
+			}
+		}
+		if !ok {
+			return
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-q.exp.wake:
+		case <-q.exp.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
 
+// remove : (queue lock held)
+func (q *Queue) remove(key string) (Cell, bool) {
 	// Repositionner les iterateurs positionnés sur le message à supprimer
-	// sur le message :
-	// 1. suivant s'il existe
-	// 2. sinon sur le précédent s'il existe
-	// 3. sinon c'est que la queue est vide
+	// sur le message précédent s'il existe, sinon au début de la queue :
+	// le prochain Get renverra ainsi le message qui suivait celui supprimé
 	cell := q.dict[key]
-	nextCell := cell.Prev() // cas 1.
-	if nextCell == nil {
-		nextCell = cell.Next() // cas 2.
+	if cell == nil {
+		return Cell{}, false
 	}
-	nextUUID := ""
-	if nextCell != nil {
-		nextUUID = nextCell.Value.(Cell).m.GetUUID()
+	prevUUID := ""
+	if prevCell := cell.Next(); prevCell != nil {
+		prevUUID = prevCell.Value.(Cell).m.GetUUID()
 	}
 
-	// suppression et repositionnement pour chaque iterateur
+	// repositionnement de chaque iterateur
 	for i := range q.iters {
-		i.m.Lock()
 		if i.current == key { // si literateur pointe sur le message à supprimer
-			i.current = nextUUID // repositionnement
+			i.current = prevUUID // repositionnement
 		}
-		// supprimer le message de la liste des messages déjà consultés
-		//delete(i.seen, key)
-		i.m.Unlock()
 	}
 
 	// supprimer le message dans la queue (dans la liste et dans la map)
+	q.exp.cancel(key)
 	delete(q.dict, key)
 	q.qlist.Remove(cell)
+	value := cell.Value.(Cell)
+	q.indexes.remove(value)
+	q.bytes -= value.size
+	q.notFull.Broadcast()
+	return value, true
 }
 
 // IsEmpty : the event queue is empty
@@ -0,0 +1,308 @@
+package msg_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestQueueExpiry : messages are removed after their timeout and the callback is called
+func TestQueueExpiry(t *testing.T) {
+	q := msg.NewQueue()
+	defer q.Close()
+	expired := make(chan string, 2)
+	q.OnExpire(func(cell *msg.Cell) {
+		expired <- cell.GetMessage().GetUUID()
+	})
+
+	short := msg.NewEventClassic("topic", "short", "")
+	short.Timeout = 20
+	long := msg.NewEventClassic("topic", "long", "")
+	q.Push(*long, "c", "localhost:8001")
+	q.Push(*short, "c", "localhost:8001")
+
+	select {
+	case uuid := <-expired:
+		if uuid != short.GetUUID() {
+			t.Errorf("expected %s to expire first, got %s", short.GetUUID(), uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message did not expire")
+	}
+	if q.First().GetMessage().GetUUID() != long.GetUUID() {
+		t.Error("long lived message should still be in the queue")
+	}
+}
+
+// TestQueueExpiryGoroutine : the expiry goroutine only runs while messages wait for their deadline
+func TestQueueExpiryGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var queues []*msg.Queue
+	for i := 0; i < 10; i++ {
+		queues = append(queues, msg.NewQueue()) // never closed
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines started by empty queues", n-before)
+	}
+	for _, q := range queues {
+		e := msg.NewEventClassic("topic", "short", "")
+		e.Timeout = 20
+		q.Push(*e, "c", "localhost:8001")
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left once the messages expired", n-before)
+	}
+	if queues[0].First() != nil {
+		t.Error("message not expired")
+	}
+}
+
+// TestQueueRemove : explicit removal repositions the iterators
+func TestQueueRemove(t *testing.T) {
+	q := msg.NewQueue()
+	defer q.Close()
+	e1 := msg.NewEventClassic("topic", "e1", "")
+	e2 := msg.NewEventClassic("topic", "e2", "")
+	e3 := msg.NewEventClassic("topic", "e3", "")
+	q.Push(*e1, "c", "localhost:8001")
+	q.Push(*e2, "c", "localhost:8001")
+	q.Push(*e3, "c", "localhost:8001")
+
+	it := msg.NewIterator(q)
+	defer it.Close()
+	it.Get()
+	if it.Get().GetMessage().GetUUID() != e2.GetUUID() {
+		t.Fatal("iterator should be on the second message")
+	}
+	if !q.Remove(e2.GetUUID()) {
+		t.Fatal("Remove should succeed on a queued message")
+	}
+	if q.Remove(e2.GetUUID()) {
+		t.Error("Remove should fail on an unknown message")
+	}
+	if cell := it.Get(); cell == nil || cell.GetMessage().GetUUID() != e3.GetUUID() {
+		t.Error("iterator should be repositioned after the removed message")
+	}
+}
+
+// TestQueueOverflow : bounded queues apply their overflow policy
+func TestQueueOverflow(t *testing.T) {
+	q := msg.NewQueueWithOptions(msg.QueueOptions{MaxCount: 2, Policy: msg.DropOldest})
+	defer q.Close()
+	dropped := 0
+	q.OnDrop(func(cell *msg.Cell) { dropped++ })
+	e1 := msg.NewEventClassic("topic", "e1", "")
+	e2 := msg.NewEventClassic("topic", "e2", "")
+	e3 := msg.NewEventClassic("topic", "e3", "")
+	q.Push(*e1, "c", "localhost:8001")
+	q.Push(*e2, "c", "localhost:8001")
+	if err := q.Put(*e3, "c", "localhost:8001"); err != nil {
+		t.Fatalf("DropOldest should accept the new message : %s", err)
+	}
+	if dropped != 1 || q.First().GetMessage().GetUUID() != e2.GetUUID() {
+		t.Error("the oldest message should have been dropped")
+	}
+
+	q.SetOptions(msg.QueueOptions{MaxCount: 2, Policy: msg.Reject})
+	e4 := msg.NewEventClassic("topic", "e4", "")
+	if err := q.Put(*e4, "c", "localhost:8001"); err != msg.ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+// TestPersistentQueue : a queue reopened from its store resumes where the iterator stopped
+func TestPersistentQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shoset_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := msg.OpenDiskStore(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := msg.NewPersistentQueue(store, msg.QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*msg.Event
+	for _, name := range []string{"e1", "e2", "e3", "e4"} {
+		e := msg.NewEventClassic("topic", name, "payload")
+		q.Push(*e, "c", "localhost:8001")
+		events = append(events, e)
+	}
+	q.Remove(events[3].GetUUID())
+	it := msg.NewIterator(q)
+	it.Get()
+	it.Get()
+	position := it.GetPosition()
+	q.Close()
+
+	store, err = msg.OpenDiskStore(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = msg.NewPersistentQueue(store, msg.QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = msg.NewIteratorFrom(q, position)
+	if cell := it.Get(); cell == nil || cell.GetMessage().GetUUID() != events[2].GetUUID() {
+		t.Fatal("iterator should resume after its last position")
+	}
+	if it.Get() != nil {
+		t.Error("removed message should not be reloaded")
+	}
+
+	replayed := 0
+	q.Replay(events[0].GetTimestamp(), func(cell *msg.Cell) bool {
+		replayed++
+		return true
+	})
+	if replayed != 4 {
+		t.Errorf("expected 4 replayed messages, got %d", replayed)
+	}
+
+	e5 := msg.NewEventClassic("topic", "e5", "payload")
+	q.Push(*e5, "c", "localhost:8001")
+	removed, _ := store.Seq(events[3].GetUUID())
+	if seq, _ := store.Seq(e5.GetUUID()); seq <= removed {
+		t.Errorf("sequence number %d of a removed message given again", seq)
+	}
+
+	q.Replay(events[0].GetTimestamp(), func(cell *msg.Cell) bool { return false }) // stopped early
+	for i := 0; i < 10; i++ {
+		q.Push(*msg.NewEventClassic("topic", "more", "payload"), "c", "localhost:8001")
+	}
+	q.Close()
+	store, err = msg.OpenDiskStore(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := store.Load()
+	store.Close()
+	if err != nil || len(cells) != 14 {
+		t.Errorf("expected 14 messages reloaded, got %d : %v", len(cells), err)
+	}
+}
+
+// TestDiskStoreTruncated : a record cut by a crash is dropped when the store is opened again,
+// the records appended afterwards are reloaded
+func TestDiskStoreTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shoset_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	push := func(name string) {
+		store, err := msg.OpenDiskStore(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := msg.NewPersistentQueue(store, msg.QueueOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Push(*msg.NewEventClassic("topic", name, "payload"), "c", "localhost:8001")
+		q.Close()
+	}
+	push("e1")
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(paths))
+	}
+	file, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 'p', 'a', 'r', 't'}) // length of 256 bytes, 4 written
+	file.Close()
+
+	push("e2")
+	store, err := msg.OpenDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cells, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || cells[1].GetMessage().(msg.Event).GetEvent() != "e2" {
+		t.Errorf("expected e1 and e2 reloaded, got %d messages", len(cells))
+	}
+}
+
+// TestDiskStoreCompact : a message removed stays removed once the segment of its tombstone is compacted
+func TestDiskStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shoset_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := msg.OpenDiskStore(dir, 1) // a segment per record
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := msg.NewPersistentQueue(store, msg.QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := msg.NewEventClassic("topic", "removed", "payload")
+	q.Push(*removed, "c", "localhost:8001")
+	q.Remove(removed.GetUUID())
+	q.Push(*msg.NewEventClassic("topic", "kept", "payload"), "c", "localhost:8001")
+	if err := store.Compact(removed.GetTimestamp()); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	store, err = msg.OpenDiskStore(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cells, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0].GetMessage().(msg.Event).GetEvent() != "kept" {
+		t.Errorf("expected only the kept message reloaded, got %d messages", len(cells))
+	}
+}
+
+// TestQueueIndexes : lookups by field only return the matching messages
+func TestQueueIndexes(t *testing.T) {
+	q := msg.NewQueue()
+	defer q.Close()
+	cmd := msg.NewCommand("target", "deploy", "")
+	reply := msg.NewEvent(map[string]string{"topic": "deploy", "event": "done", "referenceUUID": cmd.GetUUID()})
+	q.Push(*cmd, "a", "localhost:8001")
+	q.Push(*reply, "c", "localhost:8002")
+
+	if event := q.GetByReferencesUUID(cmd.GetUUID()); event == nil || event.GetUUID() != reply.GetUUID() {
+		t.Error("reply should be found by its reference UUID")
+	}
+	if cells := q.GetByCommand("deploy"); len(cells) != 1 || cells[0].GetMessage().GetUUID() != cmd.GetUUID() {
+		t.Error("command should be found by its name")
+	}
+	if cells := q.GetByRemoteShosetType("c"); len(cells) != 1 {
+		t.Error("reply should be found by its remote shoset type")
+	}
+	q.Remove(reply.GetUUID())
+	if len(q.GetByTopic("deploy")) != 0 {
+		t.Error("removed message should leave the indexes")
+	}
+}
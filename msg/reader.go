@@ -2,7 +2,8 @@ package msg
 
 import (
 	"bufio"
-	"encoding/gob"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -10,32 +11,158 @@ import (
 
 // Reader : simple bufio.Reader safe for goroutines...
 type Reader struct {
-	b *bufio.Reader
-	m sync.Mutex
+	b            *bufio.Reader
+	maxFrameSize int
+	stats        CompressionStats
+	frame        frameHeader                // header of the message being read
+	body         []byte                     // body of the message being read
+	streams      map[string]*decodingStream // one decoder per codec for the connection
+	m            sync.Mutex
+}
+
+// decodingStream : persistent decoder fed with the frame bodies of its codec
+type decodingStream struct {
+	feed *bytes.Buffer
+	dec  Decoder
 }
 
 // NewReader : constructor
 func NewReader(rd io.Reader) *Reader {
 	s := new(Reader)
 	s.b = bufio.NewReader(rd)
+	s.maxFrameSize = DefaultMaxFrameSize
+	s.streams = make(map[string]*decodingStream)
 	return s
 }
 
-// ReadString : safe version for goroutines
-func (r *Reader) ReadString() (string, error) {
+// SetMaxFrameSize : largest message body accepted, a bigger frame is refused before being read
+func (r *Reader) SetMaxFrameSize(size int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxFrameSize = size
+}
+
+// WaitFrame : wait for the first byte of the next frame, the time before it being told apart
+// from the time taken to read the frame
+func (r *Reader) WaitFrame() error {
 	r.m.Lock()
 	defer r.m.Unlock()
-	return r.b.ReadString('\n')
+	if r.b == nil {
+		return errors.New("Reader not initialized")
+	}
+	_, err := r.b.Peek(1)
+	return err
+}
+
+// ReadHeader : read the next frame and return its message type, its value is decoded by ReadMessage
+func (r *Reader) ReadHeader() (string, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.b == nil {
+		return "", errors.New("Reader not initialized")
+	}
+	h, err := readFrameHeader(r.b, r.maxFrameSize)
+	if err != nil {
+		return "", err
+	}
+	body := make([]byte, h.length)
+	if _, err := io.ReadFull(r.b, body); err != nil {
+		return "", err
+	}
+	r.stats.WireBytes += int64(len(body))
+	if h.flags&flagCompressed != 0 {
+		compressor, ok := GetCompressor(h.compression)
+		if !ok {
+			return "", errors.New("ReadHeader : unknown compressor " + h.compression)
+		}
+		if body, err = compressor.Decompress(body, r.maxFrameSize); err != nil {
+			return "", err
+		}
+	}
+	r.stats.RawBytes += int64(len(body))
+	if h.flags&flagStreamReset != 0 {
+		delete(r.streams, h.codec)
+	}
+	r.frame = h
+	r.body = body
+	return h.msgType, nil
+}
+
+// GetMeta : delivery information of the frame being read
+func (r *Reader) GetMeta() FrameMeta {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.frame.meta
+}
+
+// GetStats : size of the bodies received, before and after decompression
+func (r *Reader) GetStats() CompressionStats {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.stats
 }
 
 // ReadMessage : decode a message in a safe way for goroutines
 func (r *Reader) ReadMessage(data interface{}) error {
 	r.m.Lock()
 	defer r.m.Unlock()
-	enc := gob.NewDecoder(r.b)
-	err := enc.Decode(data)
+	stream, err := r.stream(r.frame.codec)
+	if err != nil {
+		return err
+	}
+	stream.feed.Write(r.body)
+	err = stream.dec.Decode(data)
 	if err != nil {
 		fmt.Printf("error in ReadMessage : %s\n", err)
+		delete(r.streams, r.frame.codec) // the stream state is lost
+		return err
 	}
-	return err
+	r.body = nil
+	return nil
+}
+
+// Undecoded : the frame whose value could not be decoded, as an Unknown message
+func (r *Reader) Undecoded() Unknown {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return Unknown{MsgType: r.frame.msgType, Codec: r.frame.codec, Body: r.body}
+}
+
+// SkipMessage : drop the value of the current frame while keeping the decoding stream usable,
+// and return it undecoded
+func (r *Reader) SkipMessage() (Unknown, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	unknown := Unknown{MsgType: r.frame.msgType, Codec: r.frame.codec, Body: r.body}
+	stream, err := r.stream(r.frame.codec)
+	if err != nil {
+		return unknown, err
+	}
+	stream.feed.Write(r.body)
+	r.body = nil
+	if skipper, ok := stream.dec.(Skipper); ok {
+		err = skipper.Skip()
+	} else {
+		var v interface{}
+		err = stream.dec.Decode(&v)
+	}
+	if err != nil {
+		delete(r.streams, r.frame.codec)
+	}
+	return unknown, err
+}
+
+// stream : decoding stream of a codec (reader lock held)
+func (r *Reader) stream(name string) (*decodingStream, error) {
+	stream, ok := r.streams[name]
+	if !ok {
+		codec, found := GetCodec(name)
+		if !found {
+			return nil, errors.New("ReadMessage : unknown codec " + name)
+		}
+		stream = &decodingStream{feed: new(bytes.Buffer)}
+		stream.dec = codec.NewDecoder(bufio.NewReader(stream.feed))
+		r.streams[name] = stream
+	}
+	return stream, nil
 }
@@ -0,0 +1,420 @@
+package msg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	// concrete types stored behind the Message interface
+	RegisterType(Event{})
+	RegisterType(Command{})
+	RegisterType(ConfigProtocol{})
+	RegisterType(Transfer{})
+}
+
+// RegisterType : make the messages of the concrete type of m storable in a DiskStore,
+// the processes reloading the store must register it too
+func RegisterType(m Message) {
+	gob.Register(m)
+}
+
+// Store : persistence backend of a Queue
+type Store interface {
+	Append(cell Cell) error                     // save a new message
+	Delete(key string) error                    // forget a message removed from the queue
+	Load() ([]Cell, error)                      // messages still alive, oldest first
+	Replay(from int64, f func(Cell) bool) error // every message saved since timestamp from, oldest first
+	Seq(key string) (uint64, bool)              // sequence number of a message, even removed
+	LastSeq() uint64                            // highest sequence number ever saved, removed messages included
+	Close() error
+}
+
+// DefaultSegmentSize : size after which a DiskStore starts a new segment file
+const DefaultSegmentSize = 16 * 1024 * 1024
+
+// record : on-disk representation of a Cell or of a deletion
+type record struct {
+	Key              string
+	Seq              uint64
+	Deadline         int64 // unix nano
+	RemoteShosetType string
+	RemoteAddress    string
+	Deleted          bool
+	Message          Message
+}
+
+// segment : append-only file of records
+type segment struct {
+	id           int
+	path         string
+	size         int64
+	maxTimestamp int64
+}
+
+// DiskStore : Store made of append-only segment files (length prefixed gob records)
+type DiskStore struct {
+	dir         string
+	segmentSize int64
+	segments    []*segment
+	current     *os.File
+	index       map[string]uint64 // sequence number by UUID
+	lastSeq     uint64
+	m           sync.Mutex
+}
+
+// OpenDiskStore : open (or create) the store kept in dir
+func OpenDiskStore(dir string, segmentSize int64) (*DiskStore, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := new(DiskStore)
+	s.dir = dir
+	s.segmentSize = segmentSize
+	s.index = make(map[string]uint64)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d.seg", &id); err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{id: id, path: path})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	for _, seg := range s.segments {
+		size, err := s.scan(seg, func(rec record) bool {
+			s.index[rec.Key] = rec.Seq
+			if rec.Seq > s.lastSeq {
+				s.lastSeq = rec.Seq
+			}
+			if !rec.Deleted && rec.Message.GetTimestamp() > seg.maxTimestamp {
+				seg.maxTimestamp = rec.Message.GetTimestamp()
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		seg.size = size
+	}
+	if len(s.segments) == 0 {
+		err = s.rotate()
+	} else {
+		// the records appended from now on must follow the last complete one, not a record cut by a crash
+		last := s.segments[len(s.segments)-1]
+		if err = os.Truncate(last.path, last.size); err == nil {
+			s.current, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan : read the records of a segment, a truncated last record is ignored, and return the size
+// of the records read ; the segment is not modified, OpenDiskStore truncates the last one (store lock held)
+func (s *DiskStore) scan(seg *segment, f func(record) bool) (int64, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var size int64
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		var rec record
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+			return size, errors.New("DiskStore : corrupted record in " + seg.path + " : " + err.Error())
+		}
+		size += 4 + int64(length)
+		if !f(rec) {
+			break
+		}
+	}
+	return size, nil
+}
+
+// rotate : start a new segment (store lock held)
+func (s *DiskStore) rotate() error {
+	id := 0
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.seg", id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.current != nil {
+		s.current.Close()
+	}
+	s.current = file
+	s.segments = append(s.segments, &segment{id: id, path: path})
+	return nil
+}
+
+// write : append a record to the current segment (store lock held)
+func (s *DiskStore) write(rec record) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		return err
+	}
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(4+buf.Len()) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+	frame := make([]byte, 4+buf.Len())
+	binary.BigEndian.PutUint32(frame, uint32(buf.Len()))
+	copy(frame[4:], buf.Bytes())
+	if _, err := s.current.Write(frame); err != nil {
+		return err
+	}
+	seg.size += int64(len(frame))
+	if !rec.Deleted && rec.Message.GetTimestamp() > seg.maxTimestamp {
+		seg.maxTimestamp = rec.Message.GetTimestamp()
+	}
+	return nil
+}
+
+// Append : save a new message
+func (s *DiskStore) Append(cell Cell) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := s.write(record{
+		Key:              cell.key,
+		Seq:              cell.seq,
+		Deadline:         cell.deadline.UnixNano(),
+		RemoteShosetType: cell.RemoteShosetType,
+		RemoteAddress:    cell.RemoteAddress,
+		Message:          cell.m,
+	})
+	if err == nil {
+		s.index[cell.key] = cell.seq
+		if cell.seq > s.lastSeq {
+			s.lastSeq = cell.seq
+		}
+	}
+	return err
+}
+
+// Delete : write a tombstone for a message removed from the queue
+func (s *DiskStore) Delete(key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	seq, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	return s.write(record{Key: key, Seq: seq, Deleted: true})
+}
+
+// Seq : sequence number of a message, even removed
+func (s *DiskStore) Seq(key string) (uint64, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	seq, ok := s.index[key]
+	return seq, ok
+}
+
+// LastSeq : highest sequence number ever saved, removed messages included
+func (s *DiskStore) LastSeq() uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lastSeq
+}
+
+// Load : messages neither deleted nor expired, oldest first
+func (s *DiskStore) Load() ([]Cell, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now().UnixNano()
+	var cells []Cell
+	position := make(map[string]int)
+	for _, seg := range s.segments {
+		_, err := s.scan(seg, func(rec record) bool {
+			if rec.Deleted {
+				if i, ok := position[rec.Key]; ok {
+					cells[i].key = "" // removed
+				}
+				return true
+			}
+			if rec.Deadline > now {
+				position[rec.Key] = len(cells)
+				cells = append(cells, cellFromRecord(rec))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	alive := cells[:0]
+	for _, cell := range cells {
+		if cell.key != "" {
+			alive = append(alive, cell)
+		}
+	}
+	return alive, nil
+}
+
+// Replay : call f for every message saved since timestamp from (in seconds),
+// oldest first, even if it was removed or expired since ; stop when f returns false.
+// Each segment is read with the store locked, f is called once it is unlocked.
+func (s *DiskStore) Replay(from int64, f func(Cell) bool) error {
+	s.m.Lock()
+	segments := make([]*segment, len(s.segments))
+	copy(segments, s.segments)
+	s.m.Unlock()
+
+	for i, seg := range segments {
+		var cells []Cell
+		s.m.Lock()
+		if seg.maxTimestamp < from && i < len(segments)-1 {
+			s.m.Unlock()
+			continue
+		}
+		_, err := s.scan(seg, func(rec record) bool {
+			if !rec.Deleted && rec.Message.GetTimestamp() >= from {
+				cells = append(cells, cellFromRecord(rec))
+			}
+			return true
+		})
+		s.m.Unlock()
+		if err != nil {
+			return err
+		}
+		for _, cell := range cells {
+			if !f(cell) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Compact : remove the segments holding only messages older than timestamp before (in seconds),
+// the tombstones they hold for the messages of the kept segments are written again in the current one
+func (s *DiskStore) Compact(before int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	last := s.segments[len(s.segments)-1]
+	removed := make(map[*segment]bool)
+	tombstones := make(map[string]uint64) // sequence number of the deleted message by UUID
+	for _, seg := range s.segments {
+		if seg == last || seg.maxTimestamp >= before {
+			continue
+		}
+		removed[seg] = true
+		_, err := s.scan(seg, func(rec record) bool {
+			if rec.Deleted {
+				tombstones[rec.Key] = rec.Seq
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	// a deleted message kept on the disk would be reloaded without its tombstone
+	var orphans []record
+	for _, seg := range s.segments {
+		if removed[seg] {
+			continue
+		}
+		_, err := s.scan(seg, func(rec record) bool {
+			if seq, ok := tombstones[rec.Key]; ok && seq == rec.Seq {
+				if rec.Deleted { // already kept
+					delete(tombstones, rec.Key)
+				} else {
+					orphans = append(orphans, record{Key: rec.Key, Seq: rec.Seq, Deleted: true})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, rec := range orphans {
+		if seq, ok := tombstones[rec.Key]; !ok || seq != rec.Seq {
+			continue
+		}
+		if err := s.write(rec); err != nil {
+			return err
+		}
+	}
+
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		if removed[seg] {
+			if err := os.Remove(seg.path); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	s.segments = kept
+	return nil
+}
+
+// Sync : flush the current segment to disk
+func (s *DiskStore) Sync() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.current.Sync()
+}
+
+// Close :
+func (s *DiskStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.current.Close()
+}
+
+func cellFromRecord(rec record) Cell {
+	var c Cell
+	c.key = rec.Key
+	c.seq = rec.Seq
+	c.deadline = time.Unix(0, rec.Deadline)
+	c.timeout = rec.Message.GetTimeout()
+	c.RemoteShosetType = rec.RemoteShosetType
+	c.RemoteAddress = rec.RemoteAddress
+	c.size = MessageSize(rec.Message)
+	c.m = rec.Message
+	return c
+}
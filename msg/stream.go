@@ -0,0 +1,38 @@
+package msg
+
+// Stream frame kinds
+const (
+	StreamOpen   = "open"   // open a stream, Credit : receive window of the opener
+	StreamData   = "data"   // a part of the data written on the stream
+	StreamWindow = "window" // Credit : more bytes the sender of the window may receive
+	StreamClose  = "close"  // the sender neither writes nor reads the stream anymore
+	StreamReset  = "reset"  // the stream is aborted, see Reason
+)
+
+// StreamFrame : part of a logical stream multiplexed over a connection
+type StreamFrame struct {
+	MessageBase
+	StreamID uint32
+	Kind     string
+	Data     []byte
+	Credit   int64
+	Reason   string
+}
+
+// NewStreamFrame : StreamFrame constructor
+func NewStreamFrame(streamID uint32, kind string) *StreamFrame {
+	f := new(StreamFrame)
+	f.InitMessageBase()
+	f.StreamID = streamID
+	f.Kind = kind
+	return f
+}
+
+// GetMsgType accessor
+func (f StreamFrame) GetMsgType() string { return "stream" }
+
+// GetStreamID :
+func (f StreamFrame) GetStreamID() uint32 { return f.StreamID }
+
+// GetKind :
+func (f StreamFrame) GetKind() string { return f.Kind }
@@ -0,0 +1,57 @@
+package msg
+
+import "hash/crc32"
+
+// Transfer stages
+const (
+	TransferStart = "start" // open or resume a transfer, answered by an ack
+	TransferChunk = "chunk" // a part of the data
+	TransferEnd   = "end"   // total size and digest, answered by done or abort
+	TransferAck   = "ack"   // Offset : bytes received without gap
+	TransferDone  = "done"  // the data was received and verified
+	TransferAbort = "abort" // the transfer is cancelled, see Reason
+)
+
+// Transfer : part of a large payload sent as a sequence of chunks
+type Transfer struct {
+	MessageBase
+	TransferID string
+	Stage      string
+	Name       string
+	Size       int64  // total size, known at the end
+	Offset     int64  // offset of the chunk, or acknowledged offset
+	Data       []byte // chunk data
+	Checksum   uint32 // crc32 of the chunk data
+	Digest     string // sha256 of the whole data, at the end
+	Reason     string // reason of an abort
+}
+
+// NewTransfer : Transfer constructor
+func NewTransfer(transferID, stage string) *Transfer {
+	t := new(Transfer)
+	t.InitMessageBase()
+	t.TransferID = transferID
+	t.Stage = stage
+	return t
+}
+
+// NewTransferChunk : chunk constructor, with its checksum
+func NewTransferChunk(transferID string, offset int64, data []byte) *Transfer {
+	t := NewTransfer(transferID, TransferChunk)
+	t.Offset = offset
+	t.Data = data
+	t.Checksum = crc32.ChecksumIEEE(data)
+	return t
+}
+
+// GetMsgType accessor
+func (t Transfer) GetMsgType() string { return "xfer" }
+
+// GetTransferID :
+func (t Transfer) GetTransferID() string { return t.TransferID }
+
+// GetStage :
+func (t Transfer) GetStage() string { return t.Stage }
+
+// IsValid : the chunk data matches its checksum
+func (t Transfer) IsValid() bool { return crc32.ChecksumIEEE(t.Data) == t.Checksum }
@@ -0,0 +1,12 @@
+package msg
+
+// Unknown : message of a type with no handlers, kept undecoded
+type Unknown struct {
+	MessageBase
+	MsgType string
+	Codec   string
+	Body    []byte // body of the frame, decodable alone with the codecs without stream state (json, msgpack)
+}
+
+// GetMsgType accessor
+func (u Unknown) GetMsgType() string { return u.MsgType }
@@ -2,7 +2,7 @@ package msg
 
 import (
 	"bufio"
-	"encoding/gob"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -11,25 +11,83 @@ import (
 
 // Writer : simple bufio.Writer safe for goroutines...
 type Writer struct {
-	b *bufio.Writer
-	m sync.Mutex
+	b            *bufio.Writer
+	codec        string // negotiated codec
+	maxFrameSize int
+	compression  string // negotiated compressor, "" for none
+	threshold    int    // smallest body compressed
+	stats        CompressionStats
+	streams      map[string]*encodingStream // one encoder per codec for the connection
+	m            sync.Mutex
+}
+
+// encodingStream : persistent encoder whose output is cut into frame bodies
+type encodingStream struct {
+	out   *bytes.Buffer
+	enc   Encoder
+	fresh bool // no frame sent yet
 }
 
 // NewWriter : constructor
 func NewWriter(wd io.Writer) *Writer {
 	s := new(Writer)
 	s.b = bufio.NewWriter(wd)
+	s.codec = DefaultCodec
+	s.maxFrameSize = DefaultMaxFrameSize
+	s.threshold = DefaultCompressionThreshold
+	s.streams = make(map[string]*encodingStream)
 	return s
 }
 
-// WriteString : safe version for goroutines
-func (r *Writer) WriteString(data string) (int, error) {
-	if r.b != nil {
-		r.m.Lock()
-		defer r.m.Unlock()
-		return r.b.WriteString(data + "\n")
+// SetCodec : codec used for the next messages
+func (r *Writer) SetCodec(name string) error {
+	if _, ok := GetCodec(name); !ok {
+		return errors.New("SetCodec : unknown codec " + name)
 	}
-	return 0, errors.New("Writer not ready")
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.codec = name
+	return nil
+}
+
+// GetCodec : codec used for the next messages
+func (r *Writer) GetCodec() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.codec
+}
+
+// SetMaxFrameSize : largest message body sent, a bigger message is refused
+func (r *Writer) SetMaxFrameSize(size int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxFrameSize = size
+}
+
+// SetCompression : compressor ("" for none) of the bodies of at least threshold bytes
+func (r *Writer) SetCompression(name string, threshold int) error {
+	if _, ok := GetCompressor(name); !ok && name != "" {
+		return errors.New("SetCompression : unknown compressor " + name)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.compression = name
+	r.threshold = threshold
+	return nil
+}
+
+// GetCompression : compressor of the next messages, "" for none
+func (r *Writer) GetCompression() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.compression
+}
+
+// GetStats : size of the bodies sent, before and after compression
+func (r *Writer) GetStats() CompressionStats {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.stats
 }
 
 // Flush : safe version for goroutines
@@ -42,19 +100,70 @@ func (r *Writer) Flush() error {
 	return errors.New("Writer not initialized")
 }
 
-// WriteMessage : encode a message in a safe way for goroutines
-func (r *Writer) WriteMessage(data interface{}) error {
+// Send : write a message in a frame, in a safe way for goroutines
+func (r *Writer) Send(msgType string, data interface{}) error {
+	return r.SendMeta(msgType, data, FrameMeta{})
+}
+
+// SendMeta : write a message in a frame whose header carries meta
+func (r *Writer) SendMeta(msgType string, data interface{}, meta FrameMeta) error {
 	if r.b != nil {
 		r.m.Lock()
 		defer r.m.Unlock()
-		enc := gob.NewEncoder(r.b)
-		err := enc.Encode(data)
-		r.b.Flush()
+		stream, err := r.encode(data)
 		if err != nil {
-			fmt.Println(data)
-			fmt.Printf("error in Writing Message : %s\n", err)
+			delete(r.streams, r.codec) // the stream state is lost
+			return err
+		}
+		body := stream.out.Bytes()
+		if r.maxFrameSize > 0 && len(body) > r.maxFrameSize {
+			delete(r.streams, r.codec) // this body may hold state needed by the next ones
+			return ErrFrameTooLarge
+		}
+		h := frameHeader{codec: r.codec, msgType: msgType, meta: meta}
+		if meta.Attempt > 0 {
+			h.flags |= flagAttempt
+		}
+		if meta.Seq > 0 {
+			h.flags |= flagSequenced
+		}
+		if stream.fresh {
+			h.flags |= flagStreamReset
+			stream.fresh = false
 		}
-		return err
+		r.stats.RawBytes += int64(len(body))
+		if compressor, ok := GetCompressor(r.compression); ok && len(body) >= r.threshold {
+			compressed, err := compressor.Compress(body)
+			if err == nil && len(compressed) < len(body) { // else sent raw
+				h.flags |= flagCompressed
+				h.compression = compressor.Name()
+				body = compressed
+			}
+		}
+		r.stats.WireBytes += int64(len(body))
+		if err := writeFrame(r.b, h, body); err != nil {
+			return err
+		}
+		return r.b.Flush()
 	}
 	return errors.New("Writer not initialized")
 }
+
+// encode : encode data with the current codec (writer lock held)
+func (r *Writer) encode(data interface{}) (*encodingStream, error) {
+	stream, ok := r.streams[r.codec]
+	if !ok {
+		codec, _ := GetCodec(r.codec)
+		stream = &encodingStream{out: new(bytes.Buffer), fresh: true}
+		stream.enc = codec.NewEncoder(stream.out)
+		r.streams[r.codec] = stream
+	}
+	stream.out.Reset()
+	err := stream.enc.Encode(data)
+	if err != nil {
+		fmt.Println(data)
+		fmt.Printf("error in Writing Message : %s\n", err)
+		return nil, err
+	}
+	return stream, nil
+}
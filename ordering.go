@@ -0,0 +1,198 @@
+package shoset
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// Ordering : execution order of the handlers of a type of message
+type Ordering int
+
+const (
+	// Concurrent : each message is handled in its own goroutine
+	Concurrent Ordering = iota
+	// OrderedBySender : the messages of a connection are handled one at a time, in the order they
+	// were sent whatever their priority, with the messages of the other types ordered by sender without worker pool
+	OrderedBySender
+	// OrderedByKey : the messages with the same OrderKey are handled one at a time, in reception order
+	OrderedByKey
+)
+
+// ordering : execution order of a type of message
+type ordering struct {
+	mode Ordering
+	key  func(msg.Message) string
+}
+
+// serializer : messages waiting for the handling of the previous ones with the same key
+type serializer struct {
+	lanes map[string]*lane
+	m     sync.Mutex
+}
+
+// lane : tasks waiting behind the one running
+type lane struct {
+	tasks []func()
+}
+
+func newSerializer() *serializer {
+	s := new(serializer)
+	s.lanes = make(map[string]*lane)
+	return s
+}
+
+// run : run task after the tasks of the same key, in a goroutine existing while the lane is not empty
+func (s *serializer) run(key string, task func()) {
+	s.m.Lock()
+	if l, ok := s.lanes[key]; ok {
+		l.tasks = append(l.tasks, task)
+		s.m.Unlock()
+		return
+	}
+	l := new(lane)
+	s.lanes[key] = l
+	s.m.Unlock()
+
+	go func() {
+		for {
+			task()
+			s.m.Lock()
+			if len(l.tasks) == 0 {
+				delete(s.lanes, key)
+				s.m.Unlock()
+				return
+			}
+			task = l.tasks[0]
+			l.tasks = l.tasks[1:]
+			s.m.Unlock()
+		}
+	}()
+}
+
+// reorder : messages of a connection received before messages sent earlier, released in the order of
+// their sequence numbers
+type reorder struct {
+	next    uint64            // lowest sequence number not released yet, 0 before the first frame of a socket
+	pending map[uint64]func() // received ahead, nil for the messages not handled in order
+	m       sync.Mutex
+}
+
+func newReorder() *reorder {
+	r := new(reorder)
+	r.pending = make(map[uint64]func())
+	return r
+}
+
+// receive : record the message of the frame of meta, release is called (if not nil) once the messages
+// sent before it were released, or will never come as they are below the low mark of a frame
+func (r *reorder) receive(meta msg.FrameMeta, release func()) {
+	if meta.Seq == 0 { // peer not sequencing its frames
+		if release != nil {
+			release()
+		}
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if meta.Low > r.next {
+		r.releaseBelow(meta.Low)
+		r.next = meta.Low
+	}
+	if meta.Seq < r.next { // sent again by an interceptor
+		if release != nil {
+			release()
+		}
+		return
+	}
+	r.pending[meta.Seq] = release
+	for f, ok := r.pending[r.next]; ok; f, ok = r.pending[r.next] {
+		delete(r.pending, r.next)
+		r.next++
+		if f != nil {
+			f()
+		}
+	}
+}
+
+// releaseBelow : release the pending messages sent before seq, in their order (lock held)
+func (r *reorder) releaseBelow(seq uint64) {
+	var seqs []uint64
+	for s := range r.pending {
+		if s < seq {
+			seqs = append(seqs, s)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, s := range seqs {
+		f := r.pending[s]
+		delete(r.pending, s)
+		if f != nil {
+			f()
+		}
+	}
+}
+
+// reset : a new socket starts, the messages waiting for the ones lost with the previous one are released
+func (r *reorder) reset() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.releaseBelow(^uint64(0))
+	r.next = 0
+}
+
+// SetOrdering : execution order of the handlers of a registered type of message, key is only
+// used by OrderedByKey
+func (c *Shoset) SetOrdering(msgType string, mode Ordering, key func(msg.Message) string) error {
+	if mode == OrderedByKey && key == nil {
+		return errors.New("SetOrdering : OrderedByKey needs a key function")
+	}
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	if _, ok := c.handlers[msgType]; !ok {
+		return errors.New("SetOrdering : unknown message type " + msgType)
+	}
+	c.orderings[msgType] = ordering{mode, key}
+	if pool, ok := c.pools[msgType]; ok && pool.ordered != (mode != Concurrent) {
+		c.setPool(msgType, pool.opts)
+	}
+	return nil
+}
+
+// schedule : dispatch a received message according to the ordering of its type, the messages ordered
+// by sender waiting for the ones sent before them
+func (c *Shoset) schedule(conn *ShosetConn, h Handler, m msg.Message, meta msg.FrameMeta, receivedAt time.Time) {
+	msg.ObserveClock(m.GetClock())
+	c.typesLock.RLock()
+	order := c.orderings[m.GetMsgType()]
+	pool := c.pools[m.GetMsgType()]
+	c.typesLock.RUnlock()
+
+	task := func() { c.dispatch(conn, h, m, meta, receivedAt) }
+	key := ""
+	switch order.mode {
+	case OrderedBySender:
+		key = "sender/" + conn.GetRemoteAddress()
+	case OrderedByKey:
+		key = "key/" + m.GetMsgType() + "/" + order.key(m)
+	}
+	submit := func() {
+		switch {
+		case pool != nil: // blocks the read loop while the pool is saturated
+			pool.submit(key, task)
+		case key != "":
+			c.serializer.run(key, task)
+		default:
+			go task()
+		}
+	}
+	if order.mode == OrderedBySender {
+		conn.reorder.receive(meta, submit)
+		return
+	}
+	submit()
+	conn.reorder.receive(meta, nil)
+}
@@ -0,0 +1,112 @@
+package shoset_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestOrderedBySender : the messages of a sender are handled in order, even when a handler is slow
+func TestOrderedBySender(t *testing.T) {
+	cl, aga := newShosets(t)
+	var m sync.Mutex
+	var handled []string
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			if message.GetPayload() == "slow" {
+				time.Sleep(500 * time.Millisecond)
+			}
+			m.Lock()
+			defer m.Unlock()
+			handled = append(handled, message.GetUUID())
+			return nil
+		},
+		Ordering: shoset.OrderedBySender,
+	})
+
+	conn := link(t, aga, cl)
+	var sent []string
+	for _, payload := range []string{"slow", "fast", "fast"} {
+		evt := msg.NewEventClassic("topic", "event", payload)
+		conn.SendMessage(*evt)
+		sent = append(sent, evt.GetUUID())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.Lock()
+		n := len(handled)
+		m.Unlock()
+		if n == len(sent) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(handled) != len(sent) {
+		t.Fatalf("%d messages handled", len(handled))
+	}
+	for i := range sent {
+		if handled[i] != sent[i] {
+			t.Fatalf("handled out of order : %v instead of %v", handled, sent)
+		}
+	}
+}
+
+// TestOrderedBySequence : the messages ordered by sender are handled in the order they were sent,
+// even when a higher priority makes the later ones written first
+func TestOrderedBySequence(t *testing.T) {
+	cl, aga := newShosets(t)
+	handled := make(chan string, 2)
+	spec := shoset.MessageTypeSpec{
+		Get: func(c *shoset.ShosetConn) (msg.Message, error) {
+			var evt msg.Event
+			err := c.ReadMessage(&evt)
+			return noteMessage{evt}, err
+		},
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			handled <- message.GetPayload()
+			return nil
+		},
+		NoQueue:  true,
+		Ordering: shoset.OrderedBySender,
+	}
+	cl.RegisterMessageType("note", spec)
+	aga.RegisterMessageType("note", spec)
+	stalled := make(chan bool)
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if evt, ok := m.(msg.Event); ok && evt.GetTopic() == "stall" {
+				<-stalled
+			}
+			return next(c, m)
+		}
+	})
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // the messages are written, not kept for cl
+
+	conn.SendMessage(*msg.NewEventClassic("stall", "event", "payload"))
+	time.Sleep(100 * time.Millisecond) // the writer is stalled, the notes are queued
+	first := noteMessage{*msg.NewEventClassic("topic", "event", "first")}
+	second := noteMessage{*msg.NewEventClassic("topic", "event", "second")}
+	second.Priority = msg.PriorityHigh
+	conn.SendMessage(first)
+	conn.SendMessage(second)
+	close(stalled)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case payload := <-handled:
+			if payload != expected {
+				t.Fatalf("%s handled instead of %s", payload, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not handled", expected)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package shoset
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// DefaultWriteTimeout : delay after which a write to a peer is abandoned and the socket closed,
+// see DefaultTimeouts
+const DefaultWriteTimeout = 10 * time.Second
+
+// OutboundOptions : capacity of the queues of the writer of a connection
+type OutboundOptions struct {
+	QueueSize   int // messages waiting for the writer
+	ControlSize int // control messages waiting for the writer
+}
+
+// DefaultOutboundOptions : queues of the connections of the new shosets
+var DefaultOutboundOptions = OutboundOptions{QueueSize: 1024, ControlSize: 256}
+
+// outboundOptions : outbound options of a shoset
+type outboundOptions struct {
+	opts OutboundOptions
+	m    sync.Mutex
+}
+
+// SetOutboundOptions : capacity of the queues of the connections created from now on
+func (c *Shoset) SetOutboundOptions(opts OutboundOptions) error {
+	if opts.QueueSize <= 0 || opts.ControlSize <= 0 {
+		return errors.New("SetOutboundOptions : the sizes must be positive")
+	}
+	c.outboundOptions.m.Lock()
+	defer c.outboundOptions.m.Unlock()
+	c.outboundOptions.opts = opts
+	return nil
+}
+
+// GetOutboundOptions : capacity of the queues of the connections created from now on
+func (c *Shoset) GetOutboundOptions() OutboundOptions {
+	c.outboundOptions.m.Lock()
+	defer c.outboundOptions.m.Unlock()
+	return c.outboundOptions.opts
+}
+
+// ErrOutboundFull : the message was dropped because the peer does not read its messages fast enough
+var ErrOutboundFull = errors.New("outbound queue full : message dropped")
+
+// ErrConnClosed : the connection does not send messages anymore
+var ErrConnClosed = errors.New("connection closed")
+
+// OutboundStats : messages sent on a connection
+type OutboundStats struct {
+	Queued  int   // messages waiting for the writer, control messages included
+	Control int   // control messages waiting for the writer
+	Written int64 // messages written on the socket
+	Dropped int64 // messages refused, the queue being full
+	Failed  int64 // messages whose write failed
+}
+
+// outbound : messages written on the socket of a connection by its writer goroutine, the control
+// messages first, then the others by decreasing priority and in sending order within a priority
+type outbound struct {
+	control     []queued          // written first, bounded as a peer not reading its acknowledgements fills it
+	controlSize int               // capacity of control
+	lanes       map[int8][]queued // other messages by priority
+	count       int               // messages in lanes
+	size        int               // capacity of lanes
+	seq         uint64            // sequence number of the last message queued
+	ready       chan struct{}     // a message was queued
+	room        chan struct{}     // a message was taken by the writer
+	socket      chan struct{}     // a socket was dialed or accepted, the writer waits for the first one
+	stop        chan struct{}
+	once        sync.Once
+	stats       OutboundStats
+	m           sync.Mutex // lanes and stats
+	wm          sync.Mutex // socket and writer, swapped by initBuffers
+}
+
+// queued : message waiting for the writer and its sequence number, telling the receiver the order
+// in which the messages were sent whatever the order they are written in
+type queued struct {
+	m   msg.Message
+	seq uint64
+}
+
+func newOutbound(opts OutboundOptions) *outbound {
+	o := new(outbound)
+	o.lanes = make(map[int8][]queued)
+	o.size = opts.QueueSize
+	o.controlSize = opts.ControlSize
+	o.ready = make(chan struct{}, 1)
+	o.room = make(chan struct{}, 1)
+	o.socket = make(chan struct{}, 1)
+	o.stop = make(chan struct{})
+	return o
+}
+
+// signal : wake up the goroutine waiting on a channel, if any
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// put : queue a message with the next sequence number, false when the lanes are full
+func (o *outbound) put(m msg.Message, control bool) bool {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if control && len(o.control) < o.controlSize {
+		o.seq++
+		o.control = append(o.control, queued{m, o.seq})
+	} else if !control && o.count < o.size {
+		o.seq++
+		o.lanes[m.GetPriority()] = append(o.lanes[m.GetPriority()], queued{m, o.seq})
+		o.count++
+	} else {
+		return false
+	}
+	signal(o.ready)
+	return true
+}
+
+// take : next message to write and the lowest sequence number not written yet, its own included ;
+// false when none is queued
+func (o *outbound) take() (queued, uint64, bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	var q queued
+	if len(o.control) > 0 {
+		q = o.control[0]
+		o.control = o.control[1:]
+	} else if o.count > 0 {
+		first := true
+		var priority int8
+		for p := range o.lanes {
+			if first || p > priority {
+				priority, first = p, false
+			}
+		}
+		lane := o.lanes[priority]
+		q = lane[0]
+		if len(lane) == 1 {
+			delete(o.lanes, priority)
+		} else {
+			o.lanes[priority] = lane[1:]
+		}
+		o.count--
+	} else {
+		return q, 0, false
+	}
+	signal(o.room)
+
+	low := q.seq // the heads are the oldest messages of their lanes
+	if len(o.control) > 0 && o.control[0].seq < low {
+		low = o.control[0].seq
+	}
+	for _, lane := range o.lanes {
+		if lane[0].seq < low {
+			low = lane[0].seq
+		}
+	}
+	return q, low, true
+}
+
+// isControl : the messages of the type are written before the others
+func (c *Shoset) isControl(msgType string) bool {
+	c.typesLock.RLock()
+	defer c.typesLock.RUnlock()
+	return c.control[msgType]
+}
+
+// GetOutboundStats : messages sent on the connection
+func (c *ShosetConn) GetOutboundStats() OutboundStats {
+	c.out.m.Lock()
+	defer c.out.m.Unlock()
+	stats := c.out.stats
+	stats.Control = len(c.out.control)
+	stats.Queued = c.out.count + stats.Control
+	return stats
+}
+
+// enqueue : hand a message to the writer goroutine without waiting for the socket
+func (c *ShosetConn) enqueue(m msg.Message) error {
+	select {
+	case <-c.out.stop:
+		return ErrConnClosed
+	default:
+	}
+	if !c.out.put(m, c.ch.isControl(m.GetMsgType())) {
+		c.out.m.Lock()
+		c.out.stats.Dropped++
+		c.out.m.Unlock()
+		return ErrOutboundFull
+	}
+	return nil
+}
+
+// push : queue a message, waiting for room in the queue instead of dropping it
+func (c *ShosetConn) push(m msg.Message) error {
+	control := c.ch.isControl(m.GetMsgType())
+	for {
+		select {
+		case <-c.out.stop:
+			return ErrConnClosed
+		default:
+		}
+		if c.out.put(m, control) {
+			return nil
+		}
+		select {
+		case <-c.out.room:
+		case <-c.out.stop:
+			return ErrConnClosed
+		}
+	}
+}
+
+// runWriter : write the queued messages until the connection ends, the messages sent before
+// the socket is dialed or accepted are held until then
+func (c *ShosetConn) runWriter() {
+	select {
+	case <-c.out.socket:
+	case <-c.out.stop:
+		return
+	}
+	for {
+		select {
+		case <-c.out.stop:
+			return
+		default:
+		}
+		if q, low, ok := c.out.take(); ok {
+			if c.ch.limitOutbound(c, q.m) {
+				c.write(q.m, msg.FrameMeta{Seq: q.seq, Low: low})
+			}
+			continue
+		}
+		select {
+		case <-c.out.ready:
+		case <-c.out.stop:
+			return
+		}
+	}
+}
+
+// write : write a message on the socket through the outbound interceptors, in a frame carrying
+// meta ; a socket which does not accept it before the write timeout of the connection is closed
+func (c *ShosetConn) write(m msg.Message, meta msg.FrameMeta) error {
+	meta = c.frameMeta(m, meta)
+	c.out.wm.Lock()
+	defer c.out.wm.Unlock()
+	timeout := c.getTimeouts().Write
+	c.socket.SetWriteDeadline(deadlineAfter(timeout))
+	err := c.ch.outboundHandler(func(c *ShosetConn, data msg.Message) error {
+		return writeSocket(c, data, meta)
+	})(c, m)
+
+	c.out.m.Lock()
+	if err == nil {
+		c.out.stats.Written++
+	} else {
+		c.out.stats.Failed++
+	}
+	c.out.m.Unlock()
+	if _, broken := err.(net.Error); broken {
+		if isTimeout(err) {
+			c.timedOut("write", timeout)
+		} else {
+			c.socket.Close() // the read loop ends and the connection is renewed or deleted
+		}
+	}
+	return err
+}
+
+// stopWriter : end the writer goroutine and the streams of the connection, the messages still queued are dropped
+func (c *ShosetConn) stopWriter() {
+	c.out.once.Do(func() {
+		close(c.out.stop)
+		c.streams.closeAll(ErrConnClosed)
+	})
+}
@@ -0,0 +1,145 @@
+package shoset_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestOutboundQueue : a stalled peer does not block the senders, its messages are queued then dropped
+func TestOutboundQueue(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultOutboundOptions
+	opts.QueueSize = 2
+	if err := aga.SetOutboundOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	stalled := make(chan bool)
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if evt, ok := m.(msg.Event); ok && evt.GetTopic() == "stall" {
+				<-stalled
+			}
+			return next(c, m)
+		}
+	})
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // the messages are written, not kept for cl
+
+	start := time.Now()
+	var errs []error
+	for i := 0; i < 4; i++ { // one being written, two queued, one dropped
+		errs = append(errs, conn.WriteMessage(*msg.NewEventClassic("stall", "event", "payload")))
+		time.Sleep(50 * time.Millisecond)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("senders blocked by the stalled peer")
+	}
+	if errs[0] != nil || errs[1] != nil || errs[2] != nil || errs[3] != shoset.ErrOutboundFull {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	stats := conn.GetOutboundStats()
+	if stats.Queued != 2 || stats.Dropped != 1 {
+		t.Errorf("unexpected stalled stats %+v", stats)
+	}
+
+	written := stats.Written
+	close(stalled)
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.GetOutboundStats().Written < written+3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if stats = conn.GetOutboundStats(); stats.Written != written+3 || stats.Queued != 0 {
+		t.Errorf("unexpected final stats %+v", stats)
+	}
+}
+
+// TestPriorities : the control messages are written first, then the others by decreasing priority
+func TestPriorities(t *testing.T) {
+	cl, aga := newShosets(t)
+	stalled := make(chan bool)
+	written := make(chan string, 10)
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if evt, ok := m.(msg.Event); ok {
+				if evt.GetTopic() == "stall" {
+					<-stalled
+				}
+				written <- evt.Payload
+			} else if m.GetMsgType() == "ack" {
+				written <- "ack"
+			}
+			return next(c, m)
+		}
+	})
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // the messages are written, not kept for cl
+
+	send := func(topic, payload string, priority int8) {
+		evt := msg.NewEventClassic(topic, "event", payload)
+		evt.Priority = priority
+		if err := conn.WriteMessage(*evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("stall", "stall", msg.PriorityNormal)
+	time.Sleep(100 * time.Millisecond) // being written
+	send("topic", "low", msg.PriorityLow)
+	send("topic", "normal 1", msg.PriorityNormal)
+	send("topic", "high", msg.PriorityHigh)
+	send("topic", "normal 2", msg.PriorityNormal)
+	conn.WriteMessage(*msg.NewAck("none"))
+	if stats := conn.GetOutboundStats(); stats.Queued != 5 || stats.Control != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	close(stalled)
+
+	expected := []string{"stall", "ack", "high", "normal 1", "normal 2", "low"}
+	for i, want := range expected {
+		select {
+		case got := <-written:
+			if got != want {
+				t.Errorf("message %d : got %s, expected %s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not written", i)
+		}
+	}
+}
+
+// TestOutboundBeforeSocket : a message which is not kept for its peer, sent before the socket
+// is dialed, is written once it is
+func TestOutboundBeforeSocket(t *testing.T) {
+	clAddress := freeAddress(t)
+	aga := shoset.NewShoset("aga", "aga")
+	aga.Bind(freeAddress(t))
+	spec := shoset.MessageTypeSpec{Get: shoset.GetEvent, NoForward: true}
+	aga.RegisterMessageType("evt", spec)
+	conn, err := aga.Protocol(clAddress, "link")
+	if err != nil || conn == nil {
+		t.Fatal("no connection : ", err)
+	}
+	evt := msg.NewEventClassic("topic", "event", "payload")
+	if err := conn.WriteMessage(*evt); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := shoset.NewShoset("cl", "cl")
+	received := make(chan msg.Message, 1)
+	spec.Handle = func(c *shoset.ShosetConn, m msg.Message) error {
+		received <- m
+		return nil
+	}
+	cl.RegisterMessageType("evt", spec)
+	cl.Bind(clAddress)
+	select {
+	case m := <-received:
+		if m.GetUUID() != evt.GetUUID() {
+			t.Errorf("unexpected message %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not written : %+v", conn.GetOutboundStats())
+	}
+}
@@ -0,0 +1,183 @@
+package shoset
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// PoolOptions : workers handling the messages of a type, none meaning a goroutine per message
+type PoolOptions struct {
+	Workers    int // handlers running at the same time
+	QueueDepth int // messages waiting for a worker before the read loops are blocked
+}
+
+// DefaultPoolOptions : pool suited to the "evt" and "cmd" messages, which are handled by a goroutine
+// per message unless SetPool gives them one
+var DefaultPoolOptions = PoolOptions{Workers: 16, QueueDepth: 256}
+
+// PoolStats : utilization of the worker pool of a type of message
+type PoolStats struct {
+	Workers   int
+	Busy      int           // workers running a handler
+	Queued    int           // messages waiting for a worker
+	MaxQueued int           // highest number of messages waiting
+	Processed int64         // messages handled
+	Blocked   int64         // messages which blocked a read loop, the pool being saturated
+	Waiting   time.Duration // total time spent by the messages waiting for a worker
+}
+
+// Utilization : fraction of the workers running a handler
+func (s PoolStats) Utilization() float64 {
+	if s.Workers == 0 {
+		return 0
+	}
+	return float64(s.Busy) / float64(s.Workers)
+}
+
+// workerPool : bounded workers ; an ordered pool gives each worker its own queue and sends
+// all the messages of a key to the same worker
+type workerPool struct {
+	queues  []chan poolTask // one shared queue, or one per worker when ordered
+	opts    PoolOptions
+	ordered bool
+	stats   PoolStats
+	closed  bool
+	pending sync.WaitGroup // tasks being submitted, the queues are closed once they are queued
+	m       sync.RWMutex   // closed
+	sm      sync.Mutex     // stats
+}
+
+// poolTask : message handling waiting for a worker
+type poolTask struct {
+	run      func()
+	queuedAt time.Time
+}
+
+func newWorkerPool(opts PoolOptions, ordered bool) *workerPool {
+	p := new(workerPool)
+	p.opts = opts
+	p.ordered = ordered
+	p.stats.Workers = opts.Workers
+	queues := 1
+	if ordered {
+		queues = opts.Workers
+	}
+	for i := 0; i < queues; i++ {
+		p.queues = append(p.queues, make(chan poolTask, opts.QueueDepth))
+	}
+	for i := 0; i < opts.Workers; i++ {
+		go p.work(p.queues[i%queues])
+	}
+	return p
+}
+
+// submit : queue a task, blocking while the pool is saturated ; the tasks of the same key
+// are run in order by an ordered pool
+func (p *workerPool) submit(key string, run func()) {
+	p.m.RLock()
+	if p.closed { // replaced while the message was read
+		p.m.RUnlock()
+		go run()
+		return
+	}
+	p.pending.Add(1)
+	p.m.RUnlock()
+	defer p.pending.Done()
+	queue := p.queues[0]
+	if p.ordered {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		queue = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	p.sm.Lock()
+	p.stats.Queued++
+	if p.stats.Queued > p.stats.MaxQueued {
+		p.stats.MaxQueued = p.stats.Queued
+	}
+	p.sm.Unlock()
+	task := poolTask{run: run, queuedAt: time.Now()}
+	select {
+	case queue <- task:
+	default:
+		p.sm.Lock()
+		p.stats.Blocked++
+		p.sm.Unlock()
+		queue <- task
+	}
+}
+
+// work : run the tasks of a queue until the pool is closed
+func (p *workerPool) work(queue chan poolTask) {
+	for task := range queue {
+		p.sm.Lock()
+		p.stats.Queued--
+		p.stats.Busy++
+		p.stats.Waiting += time.Since(task.queuedAt)
+		p.sm.Unlock()
+
+		task.run()
+
+		p.sm.Lock()
+		p.stats.Busy--
+		p.stats.Processed++
+		p.sm.Unlock()
+	}
+}
+
+// close : stop the workers once the queued tasks are run, the tasks being submitted included
+func (p *workerPool) close() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if !p.closed {
+		p.closed = true
+		go func() {
+			p.pending.Wait() // read loops blocked on a saturated queue
+			for _, queue := range p.queues {
+				close(queue)
+			}
+		}()
+	}
+}
+
+// getStats :
+func (p *workerPool) getStats() PoolStats {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	return p.stats
+}
+
+// SetPool : replace the worker pool of a registered type of message, no worker meaning a goroutine
+// per message ; with an ordering, the messages of a sender or key are handled by the same worker
+func (c *Shoset) SetPool(msgType string, opts PoolOptions) error {
+	c.typesLock.Lock()
+	defer c.typesLock.Unlock()
+	if _, ok := c.handlers[msgType]; !ok {
+		return errors.New("SetPool : unknown message type " + msgType)
+	}
+	c.setPool(msgType, opts)
+	return nil
+}
+
+// setPool : (typesLock held)
+func (c *Shoset) setPool(msgType string, opts PoolOptions) {
+	if old, ok := c.pools[msgType]; ok {
+		delete(c.pools, msgType)
+		old.close()
+	}
+	if opts.Workers > 0 {
+		c.pools[msgType] = newWorkerPool(opts, c.orderings[msgType].mode != Concurrent)
+	}
+}
+
+// GetPoolStats : utilization of the worker pool of a type of message, false without pool
+func (c *Shoset) GetPoolStats(msgType string) (PoolStats, bool) {
+	c.typesLock.RLock()
+	pool, ok := c.pools[msgType]
+	c.typesLock.RUnlock()
+	if !ok {
+		return PoolStats{}, false
+	}
+	return pool.getStats(), true
+}
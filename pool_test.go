@@ -0,0 +1,54 @@
+package shoset_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestWorkerPool : at most Workers handlers run at once, the others wait in the pool
+func TestWorkerPool(t *testing.T) {
+	cl, aga := newShosets(t)
+	if _, ok := cl.GetPoolStats("evt"); ok {
+		t.Error("pool for evt without SetPool")
+	}
+	release := make(chan bool)
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			<-release
+			return nil
+		},
+		Pool: shoset.PoolOptions{Workers: 2, QueueDepth: 1},
+	})
+
+	conn := link(t, aga, cl)
+	for i := 0; i < 4; i++ {
+		conn.SendMessage(*msg.NewEventClassic("topic", "event", "payload"))
+	}
+	waitStats := func(ok func(shoset.PoolStats) bool) shoset.PoolStats {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stats, _ := cl.GetPoolStats("evt")
+			if ok(stats) || time.Now().After(deadline) {
+				return stats
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	stats := waitStats(func(s shoset.PoolStats) bool { return s.Blocked > 0 })
+	if stats.Busy != 2 || stats.Queued != 2 || stats.Blocked != 1 || stats.Utilization() != 1 {
+		t.Errorf("unexpected saturated stats %+v", stats)
+	}
+	close(release)
+	stats = waitStats(func(s shoset.PoolStats) bool { return s.Processed == 4 })
+	if stats.Processed != 4 || stats.Busy != 0 || stats.Queued != 0 || stats.MaxQueued != 2 {
+		t.Errorf("unexpected final stats %+v", stats)
+	}
+	if _, ok := cl.GetPoolStats("cfglink"); ok {
+		t.Error("pool for a type without workers")
+	}
+}
@@ -0,0 +1,256 @@
+package shoset
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// RateAction : fate of a message exceeding a rate limit
+type RateAction int
+
+const (
+	// RateDelay : the message waits for its token, the read loop (the writer) being blocked meanwhile
+	RateDelay RateAction = iota
+	// RateDrop : the message is discarded
+	RateDrop
+	// RateDisconnect : the connection is closed, only for the received messages
+	RateDisconnect
+)
+
+// ErrRateLimited : the connection was closed because its peer exceeded a rate limit
+var ErrRateLimited = errors.New("rate limit exceeded : connection closed")
+
+// errRateDropped : error of the dead letters of the messages dropped by a rate limit
+var errRateDropped = errors.New("rate limit exceeded : message dropped")
+
+// RateLimit : token bucket of Rate messages per second accepting bursts of Burst messages,
+// a Rate of 0 removes the limit
+type RateLimit struct {
+	Rate   float64
+	Burst  int
+	Action RateAction // when the bucket is empty
+}
+
+// RateLimitStats : messages checked by a rate limit
+type RateLimitStats struct {
+	Accepted     int64         // messages which got their token, delayed ones included
+	Delayed      int64         // messages which waited for their token
+	Dropped      int64         // messages discarded
+	Disconnected int64         // connections closed
+	Delay        time.Duration // total time waited by the delayed messages
+}
+
+// rateLimits : rate limits of a shoset, by rule ("peer/", "shoset/", "msg/" or "out/" followed by
+// the limited name), and their buckets by rule and peer
+type rateLimits struct {
+	limits     map[string]RateLimit
+	buckets    map[string]*bucket
+	stats      map[string]*RateLimitStats
+	lastPurged time.Time
+	m          sync.Mutex
+}
+
+// bucket : tokens of a peer for a rule
+type bucket struct {
+	rule   string
+	tokens float64
+	last   time.Time
+}
+
+// bucketsPurgePeriod : delay between two removals of the buckets full again, a new bucket being full
+const bucketsPurgePeriod = time.Minute
+
+func newRateLimits() *rateLimits {
+	l := new(rateLimits)
+	l.limits = make(map[string]RateLimit)
+	l.buckets = make(map[string]*bucket)
+	l.stats = make(map[string]*RateLimitStats)
+	l.lastPurged = time.Now()
+	return l
+}
+
+// SetPeerRateLimit : limit the messages received from the peer of logical name lName
+func (c *Shoset) SetPeerRateLimit(lName string, limit RateLimit) error {
+	return c.rateLimits.set("peer/"+lName, limit)
+}
+
+// SetShosetTypeRateLimit : limit the messages received from each peer of type shosetType
+func (c *Shoset) SetShosetTypeRateLimit(shosetType string, limit RateLimit) error {
+	return c.rateLimits.set("shoset/"+shosetType, limit)
+}
+
+// SetMessageTypeRateLimit : limit the messages of type msgType received from each peer ; unlike
+// the limits by peer or shoset type, it also applies to the control messages
+func (c *Shoset) SetMessageTypeRateLimit(msgType string, limit RateLimit) error {
+	return c.rateLimits.set("msg/"+msgType, limit)
+}
+
+// SetOutboundRateLimit : limit the messages of type msgType written to each peer, by its writer
+// goroutine : the senders are not blocked, the delayed messages wait in the outbound queue
+func (c *Shoset) SetOutboundRateLimit(msgType string, limit RateLimit) error {
+	if limit.Action == RateDisconnect {
+		return errors.New("SetOutboundRateLimit : the sent messages can only be delayed or dropped")
+	}
+	return c.rateLimits.set("out/"+msgType, limit)
+}
+
+// GetRateLimitStats : messages checked by each rate limit, by rule ("peer/<lName>", "shoset/<shosetType>",
+// "msg/<msgType>" or "out/<msgType>")
+func (c *Shoset) GetRateLimitStats() map[string]RateLimitStats {
+	c.rateLimits.m.Lock()
+	defer c.rateLimits.m.Unlock()
+	stats := make(map[string]RateLimitStats)
+	for rule, s := range c.rateLimits.stats {
+		stats[rule] = *s
+	}
+	return stats
+}
+
+// set : replace the limit of a rule, its buckets start full again
+func (l *rateLimits) set(rule string, limit RateLimit) error {
+	if limit.Rate < 0 || limit.Burst < 0 {
+		return errors.New("rate limit of " + rule + " : negative rate or burst")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	for key := range l.buckets {
+		if len(key) > len(rule) && key[:len(rule)+1] == rule+"|" {
+			delete(l.buckets, key)
+		}
+	}
+	if limit.Rate == 0 {
+		delete(l.limits, rule)
+		return nil
+	}
+	l.limits[rule] = limit
+	if _, ok := l.stats[rule]; !ok {
+		l.stats[rule] = new(RateLimitStats)
+	}
+	return nil
+}
+
+// take : take a token of peer from the buckets of rules ; when a bucket without delay is empty,
+// no token is taken and the strictest action is returned, otherwise the delay before the message
+func (l *rateLimits) take(rules []string, peer string) (time.Duration, RateAction, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastPurged) > bucketsPurgePeriod {
+		l.purge(now)
+	}
+	var limits []RateLimit
+	var buckets []*bucket
+	var names []string
+	for _, rule := range rules {
+		limit, ok := l.limits[rule]
+		if !ok {
+			continue
+		}
+		burst := float64(limit.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		b, ok := l.buckets[rule+"|"+peer]
+		if !ok {
+			b = &bucket{rule: rule, tokens: burst, last: now}
+			l.buckets[rule+"|"+peer] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+		limits = append(limits, limit)
+		buckets = append(buckets, b)
+		names = append(names, rule)
+	}
+
+	action, refused := RateDelay, false
+	for i, limit := range limits {
+		if limit.Action == RateDelay || buckets[i].tokens >= 1 {
+			continue
+		}
+		refused = true
+		if limit.Action > action {
+			action = limit.Action
+		}
+		if limit.Action == RateDrop {
+			l.stats[names[i]].Dropped++
+		} else {
+			l.stats[names[i]].Disconnected++
+		}
+	}
+	if refused {
+		return 0, action, false
+	}
+
+	var wait time.Duration
+	for i, limit := range limits {
+		stats := l.stats[names[i]]
+		stats.Accepted++
+		buckets[i].tokens--
+		if buckets[i].tokens < 0 { // reserved : the token is there after the delay
+			delay := time.Duration(-buckets[i].tokens / limit.Rate * float64(time.Second))
+			stats.Delayed++
+			stats.Delay += delay
+			if delay > wait {
+				wait = delay
+			}
+		}
+	}
+	return wait, RateDelay, true
+}
+
+// purge : forget the buckets of the peers which were idle long enough to fill them again (lock held)
+func (l *rateLimits) purge(now time.Time) {
+	for key, b := range l.buckets {
+		limit, ok := l.limits[b.rule]
+		if !ok {
+			delete(l.buckets, key)
+			continue
+		}
+		burst := float64(limit.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPurged = now
+}
+
+// limitInbound : apply the rate limits to a message received on conn, false when it is dropped ;
+// ErrRateLimited when the connection must be closed
+func (c *Shoset) limitInbound(conn *ShosetConn, m msg.Message) (bool, error) {
+	rules := []string{"msg/" + m.GetMsgType()}
+	if !c.isControl(m.GetMsgType()) {
+		rules = append(rules, "peer/"+conn.GetRemoteLogicalName(), "shoset/"+conn.GetRemoteShosetType())
+	}
+	wait, action, ok := c.rateLimits.take(rules, conn.peer())
+	switch {
+	case ok:
+		time.Sleep(wait)
+		return true, nil
+	case action == RateDisconnect:
+		return false, ErrRateLimited
+	}
+	return false, nil
+}
+
+// limitOutbound : apply the rate limit of its type to a message written on conn, false when it is dropped
+func (c *Shoset) limitOutbound(conn *ShosetConn, m msg.Message) bool {
+	wait, _, ok := c.rateLimits.take([]string{"out/" + m.GetMsgType()}, conn.peer())
+	if ok && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-conn.out.stop:
+		}
+	}
+	return ok
+}
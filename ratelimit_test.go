@@ -0,0 +1,70 @@
+package shoset_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// TestRateLimits : messages over the limits are dropped, delayed or close the connection
+func TestRateLimits(t *testing.T) {
+	cl, aga := newShosets(t)
+	var handled int32
+	cl.RegisterMessageType("evt", shoset.MessageTypeSpec{
+		Get: shoset.GetEvent,
+		Handle: func(c *shoset.ShosetConn, message msg.Message) error {
+			atomic.AddInt32(&handled, 1)
+			return nil
+		},
+	})
+	cl.SetPeerRateLimit("aga", shoset.RateLimit{Rate: 0.5, Burst: 2, Action: shoset.RateDrop})
+	if err := aga.SetOutboundRateLimit("evt", shoset.RateLimit{Rate: 20, Burst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aga.SetOutboundRateLimit("cmd", shoset.RateLimit{Rate: 1, Action: shoset.RateDisconnect}); err == nil {
+		t.Error("outbound disconnection accepted")
+	}
+	dead := msg.NewIterator(cl.GetDeadLetters())
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // the messages are written, not kept for cl
+
+	for i := 0; i < 5; i++ {
+		conn.SendMessage(*msg.NewEventClassic("topic", "event", "payload"))
+	}
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Errorf("%d messages handled, expected 2", n)
+	}
+	stats := cl.GetRateLimitStats()["peer/aga"]
+	if stats.Accepted != 2 || stats.Dropped != 3 {
+		t.Errorf("unexpected inbound stats %+v", stats)
+	}
+	dropped := 0
+	for cell := dead.Get(); cell != nil; cell = dead.Get() {
+		if cell.GetMessage().(msg.DeadLetter).GetReason() == msg.DeadLetterRateLimited {
+			dropped++
+		}
+	}
+	if dropped != 3 {
+		t.Errorf("%d dropped messages dead-lettered, expected 3", dropped)
+	}
+	if stats := aga.GetRateLimitStats()["out/evt"]; stats.Accepted != 5 || stats.Delayed != 4 {
+		t.Errorf("unexpected outbound stats %+v", stats)
+	}
+
+	cl.SetPeerRateLimit("aga", shoset.RateLimit{})
+	cl.SetShosetTypeRateLimit("aga", shoset.RateLimit{Rate: 0.5, Burst: 1, Action: shoset.RateDisconnect})
+	for i := 0; i < 2; i++ {
+		conn.SendMessage(*msg.NewEventClassic("topic", "event", "payload"))
+	}
+	time.Sleep(time.Second)
+	if stats := cl.GetRateLimitStats()["shoset/aga"]; stats.Accepted != 1 || stats.Disconnected != 1 {
+		t.Errorf("unexpected disconnection stats %+v", stats)
+	}
+	if _, ok := cl.GetRateLimitStats()["peer/aga"]; !ok {
+		t.Error("stats of a removed limit forgotten")
+	}
+}
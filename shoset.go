@@ -7,6 +7,8 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ditrit/shoset/msg"
 	"github.com/spf13/viper"
@@ -20,12 +22,13 @@ var keyPath = "./certs/key.pem"
 // var certPath = "../certs/cert.pem"
 // var keyPath = "../certs/key.pem"
 
-// MessageHandlers interface
+// MessageHandlers : behaviour of a type of message, registered with RegisterMessageType
 type MessageHandlers interface {
-	Handle(*ShosetConn) error
-	SendConn(*ShosetConn, *msg.Message)
-	Send(*Shoset, *msg.Message)
-	Wait(*Shoset, *msg.Iterator, string, int) *msg.Message
+	Get(*ShosetConn) (msg.Message, error)                             // decode a received message
+	Handle(*ShosetConn, msg.Message) error                            // process a received message
+	SendConn(*ShosetConn, msg.Message) error                          // send a message to one peer
+	Send(*Shoset, msg.Message)                                        // send a message to the peers
+	Wait(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message // wait for a message in the queue
 }
 
 //Shoset :
@@ -42,16 +45,61 @@ type Shoset struct {
 	bindAddress string // Adresse sur laquelle la shoset est bindée
 
 	// Dictionnaire des queues de message (par type de message)
-	Queue  map[string]*msg.Queue
-	Get    map[string]func(*ShosetConn) (msg.Message, error)
-	Handle map[string]func(*ShosetConn, msg.Message) error
-	Send   map[string]func(*Shoset, msg.Message)
-	Wait   map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message
+	// à modifier avec RegisterMessageType (protégés par typesLock), lus avec GetQueue et GetHandlers
+	queues   map[string]*msg.Queue
+	handlers map[string]MessageHandlers
+	send     map[string]func(*Shoset, msg.Message)                                        // types having a Send function
+	wait     map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message // types having a Wait function
+
+	noForward map[string]bool     // types of message not kept for the peers unreachable
+	control   map[string]bool     // types of message written before the others
+	orderings map[string]ordering // execution order of the handlers, concurrent by default
+	pools     map[string]*workerPool
+	typesLock *sync.RWMutex // pointer : Shoset has value receivers
+
+	// interceptors of the messages received and sent (protégés par typesLock)
+	inbound  []Interceptor
+	outbound []Interceptor
+
+	// messages of unknown types : handler and count per type (protégés par typesLock)
+	fallback      Handler
+	unknownCounts map[string]int64
+	// messages which could not be delivered, kept for deadLetterRetention nanoseconds (atomic)
+	deadLetters         *msg.Queue
+	deadLetterRetention int64
+	// messages received with QoSAtLeastOnce already handled
+	dedup *dedup
+	// messages sent with QoSAtLeastOnce not acknowledged yet
+	outboxes *outboxes
+	// messages kept for the peers temporarily unreachable
+	forwarding *forwarding
+	// handlers waiting for the previous messages of their sender or key
+	serializer *serializer
+	// rate limits of the messages received and sent
+	rateLimits *rateLimits
+	// connections accepted by the listener
+	admission *admission
 
 	// configuration TLS
 	tlsConfig   *tls.Config
 	tlsServerOK bool
 
+	// codecs proposed to the peers, in preference order
+	codecs []string
+	// largest message accepted from or sent to the peers
+	maxFrameSize int
+	// chunked transfers in progress
+	transfers *transfers
+	// compressors proposed to the peers, in preference order, and smallest message compressed
+	compressions         []string
+	compressionThreshold int
+	// deadlines of the connections by type
+	timeouts *timeouts
+	// flow control of the streams
+	streamOptions *streamOptions
+	// queues of the writers of the connections
+	outboundOptions *outboundOptions
+
 	// synchronisation des goroutines
 	Done chan bool
 
@@ -60,10 +108,10 @@ type Shoset struct {
 }
 
 /*           Accessors            */
-func (c Shoset) GetBindAddress() string { return c.bindAddress }
-func (c Shoset) GetLogicalName() string { return c.lName }
-func (c Shoset) GetShosetType() string  { return c.ShosetType }
-func (c *Shoset) GetIsValid() bool      { return c.isValid }
+func (c *Shoset) GetBindAddress() string { return c.bindAddress }
+func (c *Shoset) GetLogicalName() string { return c.lName }
+func (c *Shoset) GetShosetType() string  { return c.ShosetType }
+func (c *Shoset) GetIsValid() bool       { return c.isValid }
 
 func (c *Shoset) SetBindAddress(bindAddress string) {
 	if bindAddress != "" {
@@ -75,6 +123,72 @@ func (c *Shoset) SetIsValid(state bool) {
 	c.isValid = state
 }
 
+// UsePersistentQueue : replace the queue of a message type by a queue saved in dir,
+// reloading the messages still alive from a previous run
+func (c *Shoset) UsePersistentQueue(msgType, dir string) error {
+	queue := c.GetQueue(msgType)
+	if queue == nil {
+		return errors.New("UsePersistentQueue : no queue for message type " + msgType)
+	}
+	store, err := msg.OpenDiskStore(dir, msg.DefaultSegmentSize)
+	if err != nil {
+		return err
+	}
+	persistent, err := msg.NewPersistentQueue(store, queue.GetOptions())
+	if err != nil {
+		store.Close()
+		return err
+	}
+	c.setQueue(msgType, persistent)
+	queue.Close()
+	return nil
+}
+
+// SetCodecs : codecs proposed to the peers during link and join, in preference order
+func (c *Shoset) SetCodecs(names ...string) error {
+	for _, name := range names {
+		if _, ok := msg.GetCodec(name); !ok {
+			return errors.New("SetCodecs : unknown codec " + name)
+		}
+	}
+	c.codecs = names
+	return nil
+}
+
+// SetCompressions : compressors proposed to the peers during link and join, in preference order,
+// messages smaller than threshold bytes are sent raw ; no name disables the compression
+func (c *Shoset) SetCompressions(threshold int, names ...string) error {
+	for _, name := range names {
+		if _, ok := msg.GetCompressor(name); !ok {
+			return errors.New("SetCompressions : unknown compressor " + name)
+		}
+	}
+	c.compressions = names
+	c.compressionThreshold = threshold
+	return nil
+}
+
+// offerWireOptions : advertise the codecs and the compressors of the shoset in a link or join message
+func (c *Shoset) offerWireOptions(cfg *msg.ConfigProtocol) {
+	cfg.Codecs = c.codecs
+	cfg.Compressions = c.compressions
+}
+
+// SetMaxFrameSize : largest message accepted from or sent to the peers, for the next connections
+func (c *Shoset) SetMaxFrameSize(size int) {
+	c.maxFrameSize = size
+}
+
+// SetQueueOptions : bound the queue of a message type (capacity and overflow policy)
+func (c *Shoset) SetQueueOptions(msgType string, opts msg.QueueOptions) error {
+	queue := c.GetQueue(msgType)
+	if queue == nil {
+		return errors.New("SetQueueOptions : no queue for message type " + msgType)
+	}
+	queue.SetOptions(opts)
+	return nil
+}
+
 /*       Constructor     */
 func NewShoset(lName, ShosetType string) *Shoset { //l
 	// Creation
@@ -91,44 +205,36 @@ func NewShoset(lName, ShosetType string) *Shoset { //l
 	shoset.LnamesByProtocol = NewMapSafeStrings()
 	shoset.ConnsByName.SetViper(shoset.viperConfig)
 	shoset.isValid = true
+	shoset.codecs = msg.CodecNames()
+	shoset.maxFrameSize = msg.DefaultMaxFrameSize
+	shoset.compressions = msg.CompressorNames()
+	shoset.compressionThreshold = msg.DefaultCompressionThreshold
+	shoset.timeouts = newTimeouts()
+	shoset.streamOptions = &streamOptions{opts: DefaultStreamOptions}
+	shoset.outboundOptions = &outboundOptions{opts: DefaultOutboundOptions}
 
 	// Dictionnaire des queues de message (par type de message)
-	shoset.Queue = make(map[string]*msg.Queue)
-	shoset.Get = make(map[string]func(*ShosetConn) (msg.Message, error))
-	shoset.Handle = make(map[string]func(*ShosetConn, msg.Message) error)
-	shoset.Send = make(map[string]func(*Shoset, msg.Message))
-	shoset.Wait = make(map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message)
-
-	shoset.Queue["cfglink"] = msg.NewQueue()
-	shoset.Get["cfglink"] = GetConfigLink
-	shoset.Handle["cfglink"] = HandleConfigLink
-
-	shoset.Queue["cfgjoin"] = msg.NewQueue()
-	shoset.Get["cfgjoin"] = GetConfigJoin
-	shoset.Handle["cfgjoin"] = HandleConfigJoin
-
-	shoset.Queue["cfgbye"] = msg.NewQueue()
-	shoset.Get["cfgbye"] = GetConfigBye
-	shoset.Handle["cfgbye"] = HandleConfigBye
-
-	shoset.Queue["evt"] = msg.NewQueue()
-	shoset.Get["evt"] = GetEvent
-	shoset.Handle["evt"] = HandleEvent
-	shoset.Send["evt"] = SendEvent
-	shoset.Wait["evt"] = WaitEvent
-
-	shoset.Queue["cmd"] = msg.NewQueue()
-	shoset.Get["cmd"] = GetCommand
-	shoset.Handle["cmd"] = HandleCommand
-	shoset.Send["cmd"] = SendCommand
-	shoset.Wait["cmd"] = WaitCommand
-
-	//TODO MOVE TO GANDALF
-	shoset.Queue["config"] = msg.NewQueue()
-	shoset.Get["config"] = GetConfig
-	shoset.Handle["config"] = HandleConfig
-	shoset.Send["config"] = SendConfig
-	shoset.Wait["config"] = WaitConfig
+	shoset.queues = make(map[string]*msg.Queue)
+	shoset.handlers = make(map[string]MessageHandlers)
+	shoset.noForward = make(map[string]bool)
+	shoset.control = make(map[string]bool)
+	shoset.orderings = make(map[string]ordering)
+	shoset.pools = make(map[string]*workerPool)
+	shoset.unknownCounts = make(map[string]int64)
+	shoset.deadLetters = msg.NewQueueWithOptions(DefaultDeadLetterOptions.Queue)
+	shoset.deadLetterRetention = int64(DefaultDeadLetterOptions.Retention)
+	shoset.dedup = newDedup()
+	shoset.outboxes = newOutboxes()
+	shoset.forwarding = newForwarding()
+	shoset.serializer = newSerializer()
+	shoset.rateLimits = newRateLimits()
+	shoset.admission = newAdmission()
+	shoset.send = make(map[string]func(*Shoset, msg.Message))
+	shoset.wait = make(map[string]func(*Shoset, *msg.Iterator, map[string]string, int) *msg.Message)
+
+	shoset.typesLock = new(sync.RWMutex)
+	shoset.transfers = newTransfers()
+	shoset.registerBuiltinTypes()
 
 	// Configuration TLS //////////////////////////////////// à améliorer
 	if pathCheck(certPath) && pathCheck(keyPath) {
@@ -152,7 +258,7 @@ func NewShoset(lName, ShosetType string) *Shoset { //l
 }
 
 // Display with fmt - override the print of the object
-func (c Shoset) String() string {
+func (c *Shoset) String() string {
 	descr := fmt.Sprintf("Shoset -  lName: %s,\n\t\tbindAddr : %s,\n\t\ttype : %s, \n\t\tConnsByName : ", c.GetLogicalName(), c.GetBindAddress(), c.GetShosetType())
 	for _, lName := range c.ConnsByName.Keys() {
 		c.ConnsByName.Iterate(lName,
@@ -160,8 +266,8 @@ func (c Shoset) String() string {
 				descr = fmt.Sprintf("%s %s\n\t\t\t     ", descr, val)
 			})
 	}
-	descr = fmt.Sprintf("%s \n\t\tLnamesByProtocol : MapSafeStrings{%s\n\t       ", descr, c.LnamesByProtocol)
-	descr = fmt.Sprintf("%s LnamesByType : MapSafeStrings{%s\n\t      ", descr, c.LnamesByType)
+	descr = fmt.Sprintf("%s \n\t\tLnamesByProtocol : MapSafeStrings{%v\n\t       ", descr, c.LnamesByProtocol)
+	descr = fmt.Sprintf("%s LnamesByType : MapSafeStrings{%v\n\t      ", descr, c.LnamesByType)
 	// c.LnamesByType.Iterate(
 	// 	func(key string, val map[string]bool) {
 	// 		descr = fmt.Sprintf("%s %s\n\t\t\t     ", descr, val)
@@ -173,7 +279,7 @@ func (c Shoset) String() string {
 	return descr
 }
 
-//Bind : Connect to another Shoset
+//Bind : Connect to another Shoset, listening on address ; with port 0 a free port is chosen, see GetBindAddress
 func (c *Shoset) Bind(address string) error {
 	if c.GetBindAddress() != "" { //socket already bounded to a port (already passed this Bind function once)
 		fmt.Println("Shoset already bound")
@@ -183,10 +289,17 @@ func (c *Shoset) Bind(address string) error {
 		fmt.Println("TLS configuration not OK (certificate not found / loaded)")
 		return errors.New("TLS configuration not OK (certificate not found / loaded)")
 	}
-	ipAddress, err := GetIP(address) // parse the address from function parameter to get the IP
-	if err != nil {                  // check if IP is ok
+	ipAddress, err := getIP(address, 0) // parse the address from function parameter to get the IP, port 0 for any free port
+	if err != nil {                     // check if IP is ok
 		return err
 	}
+	listener, err := net.Listen("tcp", ipAddress) //open a net listener
+	if err != nil {                                // check if listener is ok
+		fmt.Println("Failed to bind:", err.Error())
+		return err
+	}
+	ipAddress = listener.Addr().String()
+	c.SetBindAddress(ipAddress) // bound to the port, before linking to the peers of the config
 
 	viperAddress := computeAddress(ipAddress)
 	c.ConnsByName.SetConfigName(viperAddress)
@@ -215,18 +328,12 @@ func (c *Shoset) Bind(address string) error {
 		}
 	}
 
-	c.SetBindAddress(ipAddress) // bound to the port
-	go c.handleBind()           // process runInconn()
+	go c.handleBind(listener) // process runInconn()
 	return nil
 }
 
 // runBindTo : handler for the socket
-func (c *Shoset) handleBind() error {
-	listener, err := net.Listen("tcp", c.GetBindAddress()) //open a net listener
-	if err != nil {                                        // check if listener is ok
-		fmt.Println("Failed to bind:", err.Error())
-		return err
-	}
+func (c *Shoset) handleBind(listener net.Listener) error {
 	// defer WriteViper()
 	defer listener.Close()
 
@@ -239,11 +346,23 @@ func (c *Shoset) handleBind() error {
 			fmt.Printf("serverShoset accept error: %s", err)
 			break
 		}
+		ip := unencConn.RemoteAddr().(*net.TCPAddr).IP
+		admitted, handshakeTimeout := c.admission.admit(ip) // CIDR lists and connection limits
+		if !admitted {
+			unencConn.Close()
+			continue
+		}
 		tlsConn := tls.Server(unencConn, c.tlsConfig) // create the securised connection protocol
 		address := tlsConn.RemoteAddr().String()
 		conn, _ := NewShosetConn(c, address, "in") // create the securised connection
 		conn.socket = tlsConn                      //we override socket attribut with our securised protocol
-		go conn.runInConn()
+		if handshakeTimeout > 0 {
+			time.AfterFunc(handshakeTimeout, func() { c.admission.handshakeTimeout(conn) })
+		}
+		go func() {
+			defer c.admission.release(ip)
+			conn.runInConn()
+		}()
 	}
 	return nil
 }
@@ -262,7 +381,8 @@ func (c *Shoset) Protocol(address, protocolType string) (*ShosetConn, error) {
 		if address == c.GetBindAddress() { // connection impossible with itself
 			return nil, nil
 		}
-		conn, _ := NewShosetConn(c, address, "out")
+		conn, _ = NewShosetConn(c, address, "out")
+		conn.protocol = protocolType
 		go conn.runJoinConn()
 	case "link":
 		conns := c.ConnsByName.Get(c.GetLogicalName())
@@ -275,10 +395,12 @@ func (c *Shoset) Protocol(address, protocolType string) (*ShosetConn, error) {
 		if address == c.GetBindAddress() { // connection impossible with itself
 			return nil, nil
 		}
-		conn, _ := NewShosetConn(c, address, "out")
+		conn, _ = NewShosetConn(c, address, "out")
+		conn.protocol = protocolType
 		go conn.runOutConn()
 	case "bye":
-		conn, _ := NewShosetConn(c, address, "out")
+		conn, _ = NewShosetConn(c, address, "out")
+		conn.protocol = protocolType
 		go conn.runEndConn()
 	default:
 		fmt.Println("Wrong input protocolType")
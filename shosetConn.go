@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"sync"
 	"time"
 
 	//	uuid "github.com/kjk/betterguid"
@@ -16,14 +16,29 @@ import (
 // ShosetConn : client connection
 type ShosetConn struct {
 	socket           *tls.Conn
-	remoteLname      string // logical name of the socket in fornt of this one
+	remoteLname      string // logical name of the socket in fornt of this one, protected by fwd
 	remoteShosetType string // shosetType of the socket in fornt of this one
 	dir              string
 	remoteAddress    string // addresse of the socket in fornt of this one
 	ch               *Shoset
 	rb               *msg.Reader
 	wb               *msg.Writer
-	isValid          bool // for join protocol
+	isValid          bool // for join protocol, protected by tm
+	out              *outbound
+	streams          *streams
+	reorder          *reorder // received messages waiting for the ones sent before them
+	protocol         string // "link", "join" or "bye" for the connections dialed by Protocol
+	handshaked       int32  // the peer introduced itself, set atomically
+
+	// store and forward : the messages are kept for the peer while it is not connected
+	peerLname string // last remote logical name, kept while disconnected
+	connected bool
+	fwd       sync.Mutex
+
+	// timeouts : the one exceeded by the current socket, and the last one reported
+	timeout     *TimeoutError
+	closeReason error
+	tm          sync.Mutex
 }
 
 // GetDir :
@@ -35,7 +50,11 @@ func (c *ShosetConn) GetCh() *Shoset { return c.ch }
 func (c *ShosetConn) GetLocalLogicalName() string { return c.ch.GetLogicalName() }
 
 // GetName : // remote logical Name
-func (c *ShosetConn) GetRemoteLogicalName() string { return c.remoteLname }
+func (c *ShosetConn) GetRemoteLogicalName() string {
+	c.fwd.Lock()
+	defer c.fwd.Unlock()
+	return c.remoteLname
+}
 
 func (c *ShosetConn) GetLocalShosetType() string { return c.ch.GetShosetType() }
 
@@ -47,11 +66,24 @@ func (c *ShosetConn) GetLocalAddress() string { return c.ch.GetBindAddress() }
 
 func (c *ShosetConn) GetRemoteAddress() string { return c.remoteAddress }
 
-func (c *ShosetConn) GetIsValid() bool { return c.isValid }
+func (c *ShosetConn) GetIsValid() bool {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.isValid
+}
 
 // SetName : // remote logical Name
 func (c *ShosetConn) SetRemoteLogicalName(lName string) { // remote logical Name
+	c.fwd.Lock()
 	c.remoteLname = lName // remote logical Name
+	if lName != "" {
+		c.peerLname = lName
+	}
+	c.fwd.Unlock()
+	if lName != "" {
+		c.setHandshaked()
+		c.ch.outboxOf(c).expedite(c) // messages pending for the peer are sent again on this connection
+	}
 	// c.GetCh().ConnsByName.Set(c.GetName(), c.GetRemoteAddress(), c)
 }
 
@@ -70,6 +102,8 @@ func (c *ShosetConn) SetRemoteShosetType(ShosetType string) {
 }
 
 func (c *ShosetConn) SetIsValid(state bool) {
+	c.tm.Lock()
+	defer c.tm.Unlock()
 	c.isValid = state
 }
 
@@ -94,6 +128,15 @@ func NewShosetConn(c *Shoset, address string, dir string) (*ShosetConn, error) {
 	}
 	conn.remoteAddress = ipAddress
 	conn.isValid = true
+	conn.connected = dir == "in" // the others are connected by their run function
+	conn.streams = newStreams(dir, c.GetStreamOptions().Backlog)
+	conn.out = newOutbound(c.GetOutboundOptions())
+	conn.reorder = newReorder()
+	if dir == "me" { // never connected, nothing to write
+		conn.stopWriter()
+	} else {
+		go conn.runWriter()
+	}
 	return &conn, nil
 }
 
@@ -101,34 +144,50 @@ func (c *ShosetConn) String() string {
 	return fmt.Sprintf("ShosetConn{ name : %s, type : %s, way : %s, remoteAddress : %s}", c.GetRemoteLogicalName(), c.GetRemoteShosetType(), c.GetDir(), c.GetRemoteAddress())
 }
 
-// ReadString :
-func (c *ShosetConn) ReadString() (string, error) {
-	return c.rb.ReadString()
-}
-
 // ReadMessage :
 func (c *ShosetConn) ReadMessage(data interface{}) error {
 	return c.rb.ReadMessage(data)
 }
 
-// WriteString :
-func (c *ShosetConn) WriteString(data string) (int, error) {
-	return c.wb.WriteString(data)
-}
-
 // Flush :
 func (c *ShosetConn) Flush() error {
 	return c.wb.Flush()
 }
 
-// WriteMessage :
-func (c *ShosetConn) WriteMessage(data interface{}) error {
-	return c.wb.WriteMessage(data)
+// WriteMessage : send a message, kept for the peer until it is acknowledged when its QoS is QoSAtLeastOnce
+func (c *ShosetConn) WriteMessage(data msg.Message) error {
+	if data.GetQoS() >= msg.QoSAtLeastOnce {
+		c.ch.outboxOf(c).add(data, c)
+	}
+	if forwarded, err := c.forward(data); forwarded {
+		return err
+	}
+	return c.enqueue(data)
+}
+
+// writeSocket : last outbound handler, writing the message on the socket in a frame carrying meta
+func writeSocket(c *ShosetConn, data msg.Message, meta msg.FrameMeta) error {
+	return c.wb.SendMeta(data.GetMsgType(), data, meta)
+}
+
+// initBuffers : reader and writer of a new socket
+func (c *ShosetConn) initBuffers() {
+	c.out.wm.Lock()
+	c.rb = msg.NewReader(c.socket)
+	c.rb.SetMaxFrameSize(c.ch.maxFrameSize)
+	c.wb = msg.NewWriter(c.socket)
+	c.wb.SetMaxFrameSize(c.ch.maxFrameSize)
+	c.out.wm.Unlock()
+	c.reorder.reset()
+	signal(c.out.socket)
+	c.ch.outboxOf(c).expedite(c)
 }
 
 // RunOutConn : handler for the socket, for Link()
 func (c *ShosetConn) runOutConn() {
+	defer c.stopWriter()
 	myConfig := msg.NewCfg(c.ch.bindAddress, c.ch.lName, c.ch.ShosetType, "link")
+	c.ch.offerWireOptions(myConfig)
 	for {
 		if !c.GetIsValid() { // sockets are not from the same type or don't have the same name / conn ended
 			break
@@ -139,9 +198,10 @@ func (c *ShosetConn) runOutConn() {
 			time.Sleep(time.Millisecond * time.Duration(100))
 			continue
 		} else {
+			c.out.wm.Lock()
 			c.socket = conn
-			c.rb = msg.NewReader(c.socket)
-			c.wb = msg.NewWriter(c.socket)
+			c.out.wm.Unlock()
+			c.initBuffers()
 			defer conn.Close()
 
 			// receive messages
@@ -153,9 +213,14 @@ func (c *ShosetConn) runOutConn() {
 				err := c.receiveMsg()
 				time.Sleep(time.Millisecond * time.Duration(100))
 				if err != nil {
+					c.endTimeout()
 					c.SetRemoteLogicalName("") // reinitialize conn
+					c.setConnected(false)
 					break
 				}
+				if c.GetRemoteLogicalName() != "" && !c.isConnected() {
+					c.setConnected(true)
+				}
 			}
 		}
 	}
@@ -163,7 +228,9 @@ func (c *ShosetConn) runOutConn() {
 
 // RunJoinConn : handler for the socket, for Join()
 func (c *ShosetConn) runJoinConn() {
+	defer c.stopWriter()
 	joinConfig := msg.NewCfg(c.ch.bindAddress, c.ch.lName, c.ch.ShosetType, "join") //we create a new message config
+	c.ch.offerWireOptions(joinConfig)
 	for {
 		if !c.GetIsValid() { // sockets are not from the same type or don't have the same name / conn ended
 			break
@@ -175,9 +242,10 @@ func (c *ShosetConn) runJoinConn() {
 			time.Sleep(time.Millisecond * time.Duration(100))
 			continue
 		} else { // a connection occured
+			c.out.wm.Lock()
 			c.socket = conn
-			c.rb = msg.NewReader(c.socket)
-			c.wb = msg.NewWriter(c.socket)
+			c.out.wm.Unlock()
+			c.initBuffers()
 			defer conn.Close()
 
 			// receive messages
@@ -189,9 +257,14 @@ func (c *ShosetConn) runJoinConn() {
 				err := c.receiveMsg()
 				time.Sleep(time.Millisecond * time.Duration(100))
 				if err != nil {
+					c.endTimeout()
 					c.SetRemoteLogicalName("") // reinitialize conn
+					c.setConnected(false)
 					break
 				}
+				if c.GetRemoteLogicalName() != "" && !c.isConnected() {
+					c.setConnected(true)
+				}
 			}
 		}
 	}
@@ -199,6 +272,7 @@ func (c *ShosetConn) runJoinConn() {
 
 // runEndConn : handler for the socket, for Bye()
 func (c *ShosetConn) runEndConn() {
+	defer c.stopWriter()
 	// fmt.Println(c.ch.GetBindAddress(), "enter run endconn")
 	byeConfig := msg.NewCfg(c.ch.bindAddress, c.ch.lName, c.ch.ShosetType, "bye") //we create a new message config
 	for {
@@ -213,9 +287,10 @@ func (c *ShosetConn) runEndConn() {
 			time.Sleep(time.Millisecond * time.Duration(100))
 			continue
 		} else { // a connection occured
+			c.out.wm.Lock()
 			c.socket = conn
-			c.rb = msg.NewReader(c.socket)
-			c.wb = msg.NewWriter(c.socket)
+			c.out.wm.Unlock()
+			c.initBuffers()
 			defer conn.Close()
 
 			// receive messages
@@ -227,6 +302,7 @@ func (c *ShosetConn) runEndConn() {
 				err := c.receiveMsg()
 				time.Sleep(time.Millisecond * time.Duration(100))
 				if err != nil {
+					c.endTimeout()
 					c.SetRemoteLogicalName("") // reinitialize conn
 					break
 				}
@@ -237,8 +313,8 @@ func (c *ShosetConn) runEndConn() {
 
 // runInConn : handler for the connection, for handleBind()
 func (c *ShosetConn) runInConn() {
-	c.rb = msg.NewReader(c.socket)
-	c.wb = msg.NewWriter(c.socket)
+	defer c.stopWriter()
+	c.initBuffers()
 	defer c.socket.Close()
 
 	// receive messages
@@ -246,6 +322,7 @@ func (c *ShosetConn) runInConn() {
 		err := c.receiveMsg()
 		time.Sleep(time.Millisecond * time.Duration(10))
 		if err != nil {
+			c.endTimeout()
 			if err.Error() == "error : Invalid connection for join - not the same type/name or shosetConn ended" {
 				c.ch.SetIsValid(false)
 				goto Exit
@@ -257,9 +334,41 @@ Exit:
 }
 
 // SendMessage :
-func (c *ShosetConn) SendMessage(msg msg.Message) {
-	c.WriteString(msg.GetMsgType())
-	c.WriteMessage(msg)
+func (c *ShosetConn) SendMessage(msg msg.Message) error {
+	return c.WriteMessage(msg)
+}
+
+// negotiate : select the codec and the compressor written on this connection from the ones supported by the peer,
+// both ends choose the first codec (compressor) of the dialer ("out") supported by the listener ("in")
+func (c *ShosetConn) negotiate(cfg msg.ConfigProtocol) {
+	if len(cfg.Codecs) == 0 { // peer not negotiating
+		return
+	}
+	dialerCodecs, listenerCodecs := c.ch.codecs, cfg.Codecs
+	dialerCompressions, listenerCompressions := c.ch.compressions, cfg.Compressions
+	if c.GetDir() == "in" {
+		dialerCodecs, listenerCodecs = listenerCodecs, dialerCodecs
+		dialerCompressions, listenerCompressions = listenerCompressions, dialerCompressions
+	}
+	c.out.wm.Lock()
+	defer c.out.wm.Unlock()
+	c.wb.SetCodec(msg.ChooseCodec(dialerCodecs, listenerCodecs))
+	c.wb.SetCompression(msg.ChooseCompressor(dialerCompressions, listenerCompressions), c.ch.compressionThreshold)
+}
+
+// GetSentStats : size of the messages sent on this connection, before and after compression
+func (c *ShosetConn) GetSentStats() msg.CompressionStats {
+	c.out.wm.Lock()
+	defer c.out.wm.Unlock()
+	return c.wb.GetStats()
+}
+
+// GetReceivedStats : size of the messages received on this connection, before and after decompression
+func (c *ShosetConn) GetReceivedStats() msg.CompressionStats {
+	c.out.wm.Lock() // the reader is replaced with the writer
+	rb := c.rb
+	c.out.wm.Unlock()
+	return rb.GetStats()
 }
 
 func (c *ShosetConn) receiveMsg() error {
@@ -269,7 +378,7 @@ func (c *ShosetConn) receiveMsg() error {
 	}
 
 	// read message type
-	msgType, err := c.rb.ReadString()
+	msgType, err := c.readFrame()
 	switch {
 	case err == io.EOF:
 		if c.GetDir() == "in" {
@@ -282,29 +391,50 @@ func (c *ShosetConn) receiveMsg() error {
 		}
 		return errors.New("error : receiveMsg : failed to read - close this connection")
 	}
-	msgType = strings.Trim(msgType, "\n")
+	receivedAt := time.Now()
+	meta := c.rb.GetMeta()
 	// read Message Value
-	fGet, ok := c.ch.Get[msgType]
+	handlers, ok := c.ch.getHandlers(msgType)
 	if ok {
-		msgVal, err := fGet(c)
+		msgVal, err := handlers.Get(c)
 		if err == nil {
-			// read message data and handle it with the proper function
-			fHandle, ok := c.ch.Handle[msgType]
-			if ok {
-				go fHandle(c, msgVal) //HandleConfigJoin() or HandleConfigLink() or HandleConfigBye()
+			// rate limits of the peer, its shoset type and the message type
+			admitted, err := c.ch.limitInbound(c, msgVal)
+			if err != nil {
+				if c.GetDir() == "in" {
+					c.ch.deleteConn(c.GetRemoteAddress(), c.GetRemoteLogicalName())
+				}
+				return err
+			}
+			if admitted {
+				// backpressure : stop reading while the queue of this type is full
+				if queue := c.ch.GetQueue(msgType); queue != nil {
+					queue.WaitNotFull()
+				}
+				// read message data and handle it with the proper function
+				c.ch.schedule(c, handlers.Handle, msgVal, meta, receivedAt)
+			} else {
+				c.ch.drop(c, msgVal, meta, msg.DeadLetterRateLimited, errRateDropped, receivedAt)
+				c.reorder.receive(meta, nil)
 			}
 		} else {
+			c.ch.deadLetter(c, c.rb.Undecoded(), msg.DeadLetterDecodeFailed, err, receivedAt)
 			if c.GetDir() == "in" {
 				c.ch.deleteConn(c.GetRemoteAddress(), c.GetRemoteLogicalName())
 			}
 			return errors.New("receiveMsg : can not read value of " + msgType)
 		}
 	}
-	if !ok {
-		if c.GetDir() == "in" {
-			c.ch.deleteConn(c.GetRemoteAddress(), c.GetRemoteLogicalName())
+	if !ok { // sent by a newer peer : skipped, the connection stays open
+		unknown, err := c.rb.SkipMessage()
+		if err != nil {
+			if c.GetDir() == "in" {
+				c.ch.deleteConn(c.GetRemoteAddress(), c.GetRemoteLogicalName())
+			}
+			return errors.New("receiveMsg : can not skip value of non implemented type of message " + msgType)
 		}
-		return errors.New("receiveMsg : non implemented type of message " + msgType)
+		c.ch.handleUnknown(c, unknown, receivedAt)
+		c.reorder.receive(meta, nil)
 	}
 	time.Sleep(time.Millisecond * time.Duration(100)) // maybe we can remove this sleep time
 	return nil
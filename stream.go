@@ -0,0 +1,451 @@
+package shoset
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// StreamOptions : flow control of the streams
+type StreamOptions struct {
+	Window    int // bytes received on a stream and not read yet
+	FrameSize int // largest data frame
+	Backlog   int // streams opened by the peer of a connection and not accepted yet
+}
+
+// DefaultStreamOptions : streams of the new shosets
+var DefaultStreamOptions = StreamOptions{Window: 256 * 1024, FrameSize: 16 * 1024, Backlog: 64}
+
+// streamOptions : stream options of a shoset
+type streamOptions struct {
+	opts StreamOptions
+	m    sync.Mutex
+}
+
+// SetStreamOptions : flow control of the streams opened from now on, the backlog applying to the next connections
+func (c *Shoset) SetStreamOptions(opts StreamOptions) error {
+	if opts.Window <= 0 || opts.FrameSize <= 0 || opts.Backlog < 0 {
+		return errors.New("SetStreamOptions : the window and the frame size must be positive, the backlog must not be negative")
+	}
+	c.streamOptions.m.Lock()
+	defer c.streamOptions.m.Unlock()
+	c.streamOptions.opts = opts
+	return nil
+}
+
+// GetStreamOptions : flow control of the streams opened from now on
+func (c *Shoset) GetStreamOptions() StreamOptions {
+	c.streamOptions.m.Lock()
+	defer c.streamOptions.m.Unlock()
+	return c.streamOptions.opts
+}
+
+// ErrStreamClosed : the peer closed the stream
+var ErrStreamClosed = errors.New("stream closed by the peer")
+
+// streams : logical streams multiplexed over a connection, by id
+type streams struct {
+	streams map[uint32]*Stream
+	next    uint32 // odd for the dialer, even for the listener : both ends never choose the same ids
+	accept  chan *Stream
+	m       sync.Mutex
+}
+
+func newStreams(dir string, backlog int) *streams {
+	s := new(streams)
+	s.streams = make(map[uint32]*Stream)
+	s.next = 2
+	if dir == "out" {
+		s.next = 1
+	}
+	s.accept = make(chan *Stream, backlog)
+	return s
+}
+
+// Stream : ordered byte stream to the peer of a connection, with its own flow control,
+// independent of the other streams of the connection ; implements net.Conn
+type Stream struct {
+	id   uint32
+	conn *ShosetConn
+
+	buffer       []byte // received and not read yet
+	recvWindow   int64  // capacity of buffer
+	frameSize    int    // largest data frame sent
+	consumed     int64  // bytes read since the last window sent to the peer
+	window       int64  // bytes the peer may still receive
+	closed       bool
+	remoteClosed bool
+	err          error // reset
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+
+	m  sync.Mutex
+	rm sync.Mutex // one Read at a time
+	wm sync.Mutex // one Write at a time, its frames are not interleaved
+}
+
+func newStream(conn *ShosetConn, id uint32, window int64) *Stream {
+	s := new(Stream)
+	s.id = id
+	s.conn = conn
+	opts := conn.ch.GetStreamOptions()
+	s.recvWindow = int64(opts.Window)
+	s.frameSize = opts.FrameSize
+	s.window = window
+	s.readable = make(chan struct{}, 1)
+	s.writable = make(chan struct{}, 1)
+	return s
+}
+
+// OpenStream : open a new stream to the peer, accepted by AcceptStream on the other end
+func (c *ShosetConn) OpenStream() (*Stream, error) {
+	if !c.isConnected() {
+		return nil, ErrConnClosed
+	}
+	c.streams.m.Lock()
+	s := newStream(c, c.streams.next, 0) // window given by the peer
+	c.streams.next += 2
+	c.streams.streams[s.id] = s
+	c.streams.m.Unlock()
+
+	open := msg.NewStreamFrame(s.id, msg.StreamOpen)
+	open.Credit = s.recvWindow
+	if err := c.push(*open); err != nil {
+		c.streams.remove(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream : wait for the next stream opened by the peer
+func (c *ShosetConn) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-c.streams.accept:
+		return s, nil
+	case <-c.out.stop:
+		return nil, ErrConnClosed
+	}
+}
+
+// get :
+func (s *streams) get(id uint32) *Stream {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.streams[id]
+}
+
+// remove :
+func (s *streams) remove(id uint32) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.streams, id)
+}
+
+// closeAll : the connection is lost, every stream fails with err
+func (s *streams) closeAll(err error) {
+	s.m.Lock()
+	all := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.m.Unlock()
+	for _, stream := range all {
+		stream.fail(err)
+	}
+}
+
+// GetID : id of the stream, unique on its connection
+func (s *Stream) GetID() uint32 { return s.id }
+
+// GetConn : connection the stream is multiplexed on
+func (s *Stream) GetConn() *ShosetConn { return s.conn }
+
+// Read : read the data received on the stream, io.EOF once the peer closed it and everything was read
+func (s *Stream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.rm.Lock()
+	defer s.rm.Unlock()
+	for {
+		s.m.Lock()
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.m.Unlock()
+			return 0, err
+		case s.closed:
+			s.m.Unlock()
+			return 0, io.ErrClosedPipe
+		case len(s.buffer) > 0:
+			n := copy(p, s.buffer)
+			s.buffer = s.buffer[n:]
+			if len(s.buffer) == 0 {
+				s.buffer = nil
+			}
+			s.consumed += int64(n)
+			var credit int64
+			if s.consumed >= s.recvWindow/2 { // room given back to the peer by halves
+				credit, s.consumed = s.consumed, 0
+			}
+			s.m.Unlock()
+			if credit > 0 {
+				s.send(msg.StreamWindow, credit, "")
+			}
+			return n, nil
+		case s.remoteClosed:
+			s.m.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.m.Unlock()
+		if err := waitSignal(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write : write data on the stream, blocking while the peer has no room for it
+func (s *Stream) Write(p []byte) (int, error) {
+	s.wm.Lock()
+	defer s.wm.Unlock()
+	written := 0
+	for written < len(p) {
+		s.m.Lock()
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.m.Unlock()
+			return written, err
+		case s.closed:
+			s.m.Unlock()
+			return written, io.ErrClosedPipe
+		case s.remoteClosed:
+			s.m.Unlock()
+			return written, ErrStreamClosed
+		case s.window == 0:
+			deadline := s.writeDeadline
+			s.m.Unlock()
+			if err := waitSignal(s.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > s.frameSize {
+			n = s.frameSize
+		}
+		if int64(n) > s.window {
+			n = int(s.window)
+		}
+		s.window -= int64(n)
+		s.m.Unlock()
+
+		data := msg.NewStreamFrame(s.id, msg.StreamData)
+		data.Data = append([]byte(nil), p[written:written+n]...)
+		if err := s.conn.push(*data); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close : close the stream in both directions, the peer reads io.EOF after the data already written
+func (s *Stream) Close() error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return io.ErrClosedPipe
+	}
+	s.closed = true
+	reset := s.err != nil
+	done := reset || s.remoteClosed
+	s.m.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+	if done {
+		s.conn.streams.remove(s.id)
+	}
+	if reset {
+		return nil
+	}
+	return s.send(msg.StreamClose, 0, "")
+}
+
+// LocalAddr : address of the shoset and id of the stream
+func (s *Stream) LocalAddr() net.Addr { return streamAddr{s.conn.GetLocalAddress(), s.id} }
+
+// RemoteAddr : address of the peer and id of the stream
+func (s *Stream) RemoteAddr() net.Addr { return streamAddr{s.conn.GetRemoteAddress(), s.id} }
+
+// SetDeadline :
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline :
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.m.Lock()
+	s.readDeadline = t
+	s.m.Unlock()
+	signal(s.readable) // the waiting Read computes its new deadline
+	return nil
+}
+
+// SetWriteDeadline :
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.m.Lock()
+	s.writeDeadline = t
+	s.m.Unlock()
+	signal(s.writable)
+	return nil
+}
+
+// send : write a frame without data on the stream
+func (s *Stream) send(kind string, credit int64, reason string) error {
+	frame := msg.NewStreamFrame(s.id, kind)
+	frame.Credit = credit
+	frame.Reason = reason
+	return s.conn.push(*frame)
+}
+
+// fail : the stream is reset, by the peer or because the connection is lost
+func (s *Stream) fail(err error) {
+	s.m.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.m.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+}
+
+// streamAddr : net.Addr of a stream
+type streamAddr struct {
+	address string
+	id      uint32
+}
+
+func (a streamAddr) Network() string { return "shoset" }
+func (a streamAddr) String() string  { return fmt.Sprintf("%s/%d", a.address, a.id) }
+
+// timeoutError : net.Error of a deadline exceeded
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// waitSignal : wait for a signal on ch until deadline, none when zero
+func waitSignal(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return timeoutError{}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return timeoutError{}
+	}
+}
+
+// StreamHandler : MessageHandlers of the "stream" messages, frames of the streams opened with OpenStream
+type StreamHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (StreamHandler) Get(c *ShosetConn) (msg.Message, error) { return GetStreamFrame(c) }
+
+// Handle :
+func (StreamHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleStreamFrame(c, message)
+}
+
+// GetStreamFrame :
+func GetStreamFrame(c *ShosetConn) (msg.Message, error) {
+	var f msg.StreamFrame
+	err := c.ReadMessage(&f)
+	return f, err
+}
+
+// HandleStreamFrame : frames of a connection are handled one at a time, in reception order
+func HandleStreamFrame(c *ShosetConn, message msg.Message) error {
+	f := message.(msg.StreamFrame)
+	if f.GetKind() == msg.StreamOpen {
+		c.streams.m.Lock()
+		if _, ok := c.streams.streams[f.GetStreamID()]; ok {
+			c.streams.m.Unlock()
+			return nil
+		}
+		s := newStream(c, f.GetStreamID(), f.Credit)
+		c.streams.streams[s.id] = s
+		c.streams.m.Unlock()
+		select {
+		case c.streams.accept <- s:
+			return s.send(msg.StreamWindow, s.recvWindow, "")
+		default:
+			c.streams.remove(s.id)
+			return s.send(msg.StreamReset, 0, "backlog full")
+		}
+	}
+
+	s := c.streams.get(f.GetStreamID())
+	if s == nil {
+		if f.GetKind() == msg.StreamData || f.GetKind() == msg.StreamWindow {
+			return newStream(c, f.GetStreamID(), 0).send(msg.StreamReset, 0, "unknown stream")
+		}
+		return nil
+	}
+	switch f.GetKind() {
+	case msg.StreamData:
+		s.m.Lock()
+		if s.closed { // data in flight when the stream was closed
+			s.m.Unlock()
+			return nil
+		}
+		if int64(len(s.buffer)+len(f.Data)) > s.recvWindow {
+			s.m.Unlock()
+			c.streams.remove(s.id)
+			s.fail(errors.New("stream flow control window exceeded by the peer"))
+			return s.send(msg.StreamReset, 0, "flow control window exceeded")
+		}
+		s.buffer = append(s.buffer, f.Data...)
+		s.m.Unlock()
+		signal(s.readable)
+	case msg.StreamWindow:
+		s.m.Lock()
+		s.window += f.Credit
+		s.m.Unlock()
+		signal(s.writable)
+	case msg.StreamClose:
+		s.m.Lock()
+		s.remoteClosed = true
+		done := s.closed
+		s.m.Unlock()
+		signal(s.readable)
+		signal(s.writable)
+		if done {
+			c.streams.remove(s.id)
+		}
+	case msg.StreamReset:
+		c.streams.remove(s.id)
+		s.fail(errors.New("stream reset by the peer : " + f.Reason))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package shoset_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+)
+
+// TestStreams : data larger than the flow control window goes through a stream, in order, while
+// another stream of the same connection stays independent
+func TestStreams(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultStreamOptions
+	opts.Window = 64 * 1024
+	if err := cl.SetStreamOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if aga.GetStreamOptions() != shoset.DefaultStreamOptions {
+		t.Error("stream options of another shoset changed")
+	}
+	conn := link(t, aga, cl)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cl.GetConnsByTypeArray("aga")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	in := cl.GetConnsByTypeArray("aga")[0]
+	time.Sleep(500 * time.Millisecond) // conn is connected once the link is confirmed
+
+	data := make([]byte, 2*shoset.DefaultStreamOptions.Window) // larger than the windows of both ends
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	go func() {
+		s, err := in.AcceptStream()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Error(err)
+		}
+		received <- buf
+		s.Write([]byte("done"))
+		s.Close()
+	}()
+
+	var s net.Conn
+	s, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := idle.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	if n, err := s.Write(data); n != len(data) || err != nil {
+		t.Fatalf("written %d bytes : %v", n, err)
+	}
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Error("data corrupted")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("data not received")
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(s, reply); err != nil || string(reply) != "done" {
+		t.Errorf("unexpected reply %q : %v", reply, err)
+	}
+	if _, err := s.Read(reply); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if _, err := s.Write(reply); err != shoset.ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed, got %v", err)
+	}
+	s.Close()
+}
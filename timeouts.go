@@ -0,0 +1,171 @@
+package shoset
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts : deadlines of the connections of a type ("in" accepted by the listener, "out" dialed
+// by Link or Bye, "join" dialed by Join), none when 0
+type Timeouts struct {
+	Read      time.Duration // to receive a message once its first byte arrived
+	Write     time.Duration // to write a message
+	Idle      time.Duration // without receiving any message
+	Reconnect bool          // dial again a connection closed by a timeout, else it ends ; not for "in"
+}
+
+// DefaultTimeouts : timeouts of every type of connection of the new shosets
+var DefaultTimeouts = Timeouts{Write: DefaultWriteTimeout, Reconnect: true}
+
+// TimeoutError : reason of a connection closed because it exceeded a timeout
+type TimeoutError struct {
+	Kind    string // "read", "write" or "idle"
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s exceeded", e.Kind, e.Timeout)
+}
+
+// timeouts : timeouts of a shoset by type of connection
+type timeouts struct {
+	byType    map[string]Timeouts
+	onTimeout func(*ShosetConn, error)
+	m         sync.Mutex
+}
+
+func newTimeouts() *timeouts {
+	t := new(timeouts)
+	t.byType = map[string]Timeouts{"in": DefaultTimeouts, "out": DefaultTimeouts, "join": DefaultTimeouts}
+	return t
+}
+
+// SetTimeouts : deadlines of the connections of type connType ("in", "out" or "join"),
+// applied from their next message
+func (c *Shoset) SetTimeouts(connType string, t Timeouts) error {
+	c.timeouts.m.Lock()
+	defer c.timeouts.m.Unlock()
+	if _, ok := c.timeouts.byType[connType]; !ok {
+		return errors.New("SetTimeouts : unknown type of connection " + connType)
+	}
+	c.timeouts.byType[connType] = t
+	return nil
+}
+
+// GetTimeouts : deadlines of the connections of type connType
+func (c *Shoset) GetTimeouts(connType string) Timeouts {
+	c.timeouts.m.Lock()
+	defer c.timeouts.m.Unlock()
+	return c.timeouts.byType[connType]
+}
+
+// SetWriteTimeout : delay after which a write to a peer is abandoned and its socket closed,
+// for every type of connection
+func (c *Shoset) SetWriteTimeout(timeout time.Duration) {
+	c.timeouts.m.Lock()
+	defer c.timeouts.m.Unlock()
+	for connType, t := range c.timeouts.byType {
+		t.Write = timeout
+		c.timeouts.byType[connType] = t
+	}
+}
+
+// OnConnTimeout : register the function called with each connection closed by a timeout,
+// and its *TimeoutError
+func (c *Shoset) OnConnTimeout(f func(*ShosetConn, error)) {
+	c.timeouts.m.Lock()
+	defer c.timeouts.m.Unlock()
+	c.timeouts.onTimeout = f
+}
+
+// GetCloseReason : timeout which closed the connection last, nil if none did
+func (c *ShosetConn) GetCloseReason() error {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.closeReason
+}
+
+// connType : type of the connection for its timeouts
+func (c *ShosetConn) connType() string {
+	switch {
+	case c.GetDir() == "in":
+		return "in"
+	case c.protocol == "join":
+		return "join"
+	}
+	return "out"
+}
+
+// getTimeouts :
+func (c *ShosetConn) getTimeouts() Timeouts {
+	return c.ch.GetTimeouts(c.connType())
+}
+
+// readFrame : read the next frame within the idle timeout, then the read timeout once it started
+func (c *ShosetConn) readFrame() (string, error) {
+	t := c.getTimeouts()
+	c.socket.SetReadDeadline(deadlineAfter(t.Idle))
+	if err := c.rb.WaitFrame(); err != nil {
+		if isTimeout(err) {
+			c.timedOut("idle", t.Idle)
+		}
+		return "", err
+	}
+	c.socket.SetReadDeadline(deadlineAfter(t.Read))
+	msgType, err := c.rb.ReadHeader()
+	if isTimeout(err) {
+		c.timedOut("read", t.Read)
+	}
+	return msgType, err
+}
+
+// deadlineAfter : deadline of a timeout, none when 0
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// timedOut : close the socket of a connection which exceeded a timeout, its read loop ends
+func (c *ShosetConn) timedOut(kind string, timeout time.Duration) {
+	c.tm.Lock()
+	if c.timeout == nil {
+		c.timeout = &TimeoutError{kind, timeout}
+	}
+	c.tm.Unlock()
+	c.socket.Close()
+}
+
+// endTimeout : called when the read loop of the connection fails ; after a timeout, the reason is
+// reported and the connection ends unless it reconnects
+func (c *ShosetConn) endTimeout() {
+	c.tm.Lock()
+	reason := c.timeout
+	c.timeout = nil
+	if reason != nil {
+		c.closeReason = reason
+	}
+	c.tm.Unlock()
+	if reason == nil {
+		return
+	}
+	c.ch.timeouts.m.Lock()
+	onTimeout := c.ch.timeouts.onTimeout
+	c.ch.timeouts.m.Unlock()
+	if onTimeout != nil {
+		go onTimeout(c, reason)
+	}
+	if c.GetDir() != "in" && !c.getTimeouts().Reconnect {
+		c.SetIsValid(false)
+		c.ch.deleteConn(c.GetRemoteAddress(), c.GetRemoteLogicalName())
+	}
+}
@@ -0,0 +1,49 @@
+package shoset_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+)
+
+// TestIdleTimeout : idle connections are closed and reported, then dialed again or ended
+func TestIdleTimeout(t *testing.T) {
+	cl, aga := newShosets(t)
+	if err := cl.SetTimeouts("bye", shoset.Timeouts{}); err == nil {
+		t.Error("unknown type of connection accepted")
+	}
+	reasons := make(chan error, 10)
+	cl.OnConnTimeout(func(c *shoset.ShosetConn, reason error) {
+		if c.GetDir() == "in" {
+			reasons <- reason
+		}
+	})
+	cl.SetTimeouts("in", shoset.Timeouts{Idle: 300 * time.Millisecond})
+	link(t, aga, cl)
+	select {
+	case reason := <-reasons:
+		if timeout, ok := reason.(*shoset.TimeoutError); !ok || timeout.Kind != "idle" {
+			t.Errorf("unexpected reason %v", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+
+	cl, aga = newShosets(t)
+	aga.SetTimeouts("out", shoset.Timeouts{Idle: 300 * time.Millisecond})
+	conn := link(t, aga, cl)
+	if reason := conn.GetCloseReason(); reason != nil {
+		t.Errorf("open connection closed by %v", reason)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.GetIsValid() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if timeout, ok := conn.GetCloseReason().(*shoset.TimeoutError); conn.GetIsValid() || !ok || timeout.Kind != "idle" {
+		t.Errorf("connection not ended by its idle timeout : %v", conn.GetCloseReason())
+	}
+	if len(aga.GetConnsByTypeArray("cl")) != 0 {
+		t.Error("ended connection still known")
+	}
+}
@@ -0,0 +1,506 @@
+package shoset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	uuid "github.com/kjk/betterguid"
+
+	"github.com/ditrit/shoset/msg"
+)
+
+// TransferOptions : chunking, flow control and limits of the transfers
+type TransferOptions struct {
+	ChunkSize   int           // size of the chunks
+	Window      int           // chunks sent and not acknowledged yet
+	AckTimeout  time.Duration // delay before resuming a transfer without news of the receiver
+	Timeout     time.Duration // delay after which a transfer without progress is aborted
+	IdleTimeout time.Duration // delay after which an incomplete incoming transfer is dropped
+	MaxSize     int64         // size above which an incoming transfer is aborted
+	MaxIncoming int           // incomplete incoming transfers, the next ones are aborted
+}
+
+// DefaultTransferOptions : transfers of the new shosets
+var DefaultTransferOptions = TransferOptions{
+	ChunkSize:   64 * 1024,
+	Window:      16,
+	AckTimeout:  5 * time.Second,
+	Timeout:     2 * time.Minute,
+	IdleTimeout: 10 * time.Minute,
+	MaxSize:     1 << 32,
+	MaxIncoming: 16,
+}
+
+// transfers : transfers in progress of a shoset
+type transfers struct {
+	out        map[string]*outgoingTransfer
+	in         map[string]*IncomingTransfer
+	onComplete func(*IncomingTransfer)
+	opts       TransferOptions
+	m          sync.Mutex
+}
+
+func newTransfers() *transfers {
+	t := new(transfers)
+	t.out = make(map[string]*outgoingTransfer)
+	t.in = make(map[string]*IncomingTransfer)
+	t.opts = DefaultTransferOptions
+	return t
+}
+
+// options : transfer options of the shoset
+func (t *transfers) options() TransferOptions {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.opts
+}
+
+// SetTransferOptions : chunking, flow control and limits of the transfers started from now on
+func (c *Shoset) SetTransferOptions(opts TransferOptions) error {
+	if opts.ChunkSize <= 0 || opts.Window <= 0 || opts.AckTimeout <= 0 || opts.Timeout <= 0 || opts.IdleTimeout <= 0 || opts.MaxSize <= 0 || opts.MaxIncoming <= 0 {
+		return errors.New("SetTransferOptions : the options must be positive")
+	}
+	c.transfers.m.Lock()
+	defer c.transfers.m.Unlock()
+	c.transfers.opts = opts
+	return nil
+}
+
+// GetTransferOptions : chunking, flow control and limits of the transfers started from now on
+func (c *Shoset) GetTransferOptions() TransferOptions {
+	return c.transfers.options()
+}
+
+// outgoingTransfer : state of a transfer sent by this shoset
+type outgoingTransfer struct {
+	acked  int64 // bytes received without gap by the peer
+	result *msg.Transfer
+	news   chan struct{}
+	m      sync.Mutex
+}
+
+// IncomingTransfer : data received through a transfer, reassembled in a temporary file
+type IncomingTransfer struct {
+	ID          string
+	Name        string
+	ContentType string
+	Size        int64
+	From        *ShosetConn
+
+	file       *os.File
+	received   map[int64]int64 // length of the chunks received by offset
+	contiguous int64           // bytes received without gap
+	end        *msg.Transfer
+	done       bool
+	lastSeen   time.Time
+	m          sync.Mutex
+}
+
+// Reader : the received data, the temporary file is removed when it is closed
+func (t *IncomingTransfer) Reader() (io.ReadCloser, error) {
+	file, err := os.Open(t.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &transferReader{file}, nil
+}
+
+// transferReader : reader of a received transfer removing its file when closed
+type transferReader struct {
+	*os.File
+}
+
+func (r *transferReader) Close() error {
+	err := r.File.Close()
+	os.Remove(r.File.Name())
+	return err
+}
+
+// OnTransfer : register the function called with each transfer completely received
+func (c *Shoset) OnTransfer(f func(*IncomingTransfer)) {
+	c.transfers.m.Lock()
+	defer c.transfers.m.Unlock()
+	c.transfers.onComplete = f
+}
+
+// SendPayload : send data to the peer of conn as a transfer
+func (c *Shoset) SendPayload(conn *ShosetConn, name, contentType string, data []byte) error {
+	return c.SendTransfer(conn, name, contentType, bytes.NewReader(data))
+}
+
+// SendTransfer : send the content of r to the peer of conn in chunks, without holding it in memory.
+// The chunks not acknowledged yet are kept so that the transfer resumes after a reconnection.
+func (c *Shoset) SendTransfer(conn *ShosetConn, name, contentType string, r io.Reader) error {
+	id := uuid.New()
+	out := &outgoingTransfer{news: make(chan struct{}, 1)}
+	c.transfers.m.Lock()
+	c.transfers.out[id] = out
+	opts := c.transfers.opts
+	c.transfers.m.Unlock()
+	defer func() {
+		c.transfers.m.Lock()
+		delete(c.transfers.out, id)
+		c.transfers.m.Unlock()
+	}()
+
+	start := msg.NewTransfer(id, msg.TransferStart)
+	start.Name = name
+	start.ContentType = contentType
+
+	digest := sha256.New()
+	var pending []*msg.Transfer // sent and not acknowledged
+	var offset int64
+	eof := false
+	broken := true // the start is sent as a resume
+	progress := time.Now()
+
+	for {
+		if broken { // resume : ask the peer where it is and send again what it misses
+			if time.Since(progress) > opts.Timeout {
+				c.abortTransfer(conn, id, "timeout")
+				return errors.New("SendTransfer : no progress of transfer " + id)
+			}
+			if conn.WriteMessage(*start) != nil {
+				time.Sleep(opts.AckTimeout / 10) // wait for the reconnection
+				continue
+			}
+			acked, result, ok := out.wait(opts.AckTimeout)
+			if result != nil {
+				return errors.New("SendTransfer : transfer " + id + " aborted by the peer : " + result.Reason)
+			}
+			if !ok {
+				continue
+			}
+			for len(pending) > 0 && pending[0].Offset+int64(len(pending[0].Data)) <= acked {
+				pending = pending[1:]
+				progress = time.Now()
+			}
+			broken = false
+			for _, chunk := range pending {
+				if broken = conn.WriteMessage(*chunk) != nil; broken {
+					break
+				}
+			}
+			continue
+		}
+
+		for !eof && !broken && len(pending) < opts.Window {
+			data := make([]byte, opts.ChunkSize)
+			n, err := io.ReadFull(r, data)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				c.abortTransfer(conn, id, err.Error())
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			digest.Write(data[:n])
+			chunk := msg.NewTransferChunk(id, offset, data[:n])
+			offset += int64(n)
+			pending = append(pending, chunk)
+			broken = conn.WriteMessage(*chunk) != nil
+		}
+		if eof && len(pending) == 0 {
+			break
+		}
+		if broken {
+			continue
+		}
+
+		acked, result, ok := out.wait(opts.AckTimeout)
+		if result != nil {
+			return errors.New("SendTransfer : transfer " + id + " aborted by the peer : " + result.Reason)
+		}
+		for len(pending) > 0 && pending[0].Offset+int64(len(pending[0].Data)) <= acked {
+			pending = pending[1:]
+			progress = time.Now()
+		}
+		broken = !ok
+	}
+
+	end := msg.NewTransfer(id, msg.TransferEnd)
+	end.Size = offset
+	end.Digest = hex.EncodeToString(digest.Sum(nil))
+	progress = time.Now()
+	for {
+		conn.WriteMessage(*end)
+		if _, result, _ := out.wait(opts.AckTimeout); result != nil {
+			if result.GetStage() == msg.TransferAbort {
+				return errors.New("SendTransfer : transfer " + id + " aborted by the peer : " + result.Reason)
+			}
+			return nil
+		}
+		if time.Since(progress) > opts.Timeout {
+			c.abortTransfer(conn, id, "timeout")
+			return errors.New("SendTransfer : transfer " + id + " not confirmed")
+		}
+	}
+}
+
+// wait : wait for news of the peer, return the acknowledged offset and the final answer if any
+func (t *outgoingTransfer) wait(timeout time.Duration) (int64, *msg.Transfer, bool) {
+	ok := true
+	select {
+	case <-t.news:
+	case <-time.After(timeout):
+		ok = false
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.acked, t.result, ok
+}
+
+// notify : news of the peer about an outgoing transfer
+func (t *outgoingTransfer) notify(reply msg.Transfer) {
+	t.m.Lock()
+	switch reply.GetStage() {
+	case msg.TransferAck:
+		if reply.Offset > t.acked {
+			t.acked = reply.Offset
+		}
+	case msg.TransferDone, msg.TransferAbort:
+		t.result = &reply
+	}
+	t.m.Unlock()
+	select {
+	case t.news <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Shoset) abortTransfer(conn *ShosetConn, id, reason string) {
+	abort := msg.NewTransfer(id, msg.TransferAbort)
+	abort.Reason = reason
+	conn.WriteMessage(*abort)
+}
+
+// TransferHandler : MessageHandlers of the "xfer" messages, sent with SendTransfer
+type TransferHandler struct {
+	protocolHandler
+}
+
+// Get :
+func (TransferHandler) Get(c *ShosetConn) (msg.Message, error) { return GetTransfer(c) }
+
+// Handle :
+func (TransferHandler) Handle(c *ShosetConn, message msg.Message) error {
+	return HandleTransfer(c, message)
+}
+
+// GetTransfer :
+func GetTransfer(c *ShosetConn) (msg.Message, error) {
+	var t msg.Transfer
+	err := c.ReadMessage(&t)
+	return t, err
+}
+
+// HandleTransfer :
+func HandleTransfer(c *ShosetConn, message msg.Message) error {
+	t := message.(msg.Transfer)
+	transfers := c.GetCh().transfers
+	opts := transfers.options()
+
+	switch t.GetStage() {
+	case msg.TransferAck, msg.TransferDone:
+		transfers.m.Lock()
+		out := transfers.out[t.GetTransferID()]
+		transfers.m.Unlock()
+		if out != nil {
+			out.notify(t)
+		}
+		return nil
+	case msg.TransferAbort:
+		transfers.m.Lock()
+		out := transfers.out[t.GetTransferID()]
+		in := transfers.in[t.GetTransferID()]
+		delete(transfers.in, t.GetTransferID())
+		transfers.m.Unlock()
+		if out != nil {
+			out.notify(t)
+		}
+		if in != nil {
+			in.discard()
+		}
+		return nil
+	}
+
+	in, err := transfers.incoming(c, t)
+	if err != nil {
+		c.GetCh().abortTransfer(c, t.GetTransferID(), err.Error())
+		return err
+	}
+	if in == nil {
+		return nil
+	}
+	in.m.Lock()
+	in.lastSeen = time.Now()
+	switch t.GetStage() {
+	case msg.TransferChunk:
+		if in.done || !t.IsValid() || t.Offset < in.contiguous {
+			break // a corrupted chunk is sent again on resume, an acknowledged one is already written
+		}
+		if end := t.Offset + int64(len(t.Data)); end > opts.MaxSize || (in.end != nil && end > in.end.Size) {
+			err = errors.New("HandleTransfer : chunk beyond the size of transfer " + in.ID)
+			break
+		}
+		if _, ok := in.received[t.Offset]; !ok {
+			if _, err := in.file.WriteAt(t.Data, t.Offset); err != nil {
+				in.m.Unlock()
+				return err
+			}
+			in.received[t.Offset] = int64(len(t.Data))
+			for length, ok := in.received[in.contiguous]; ok; length, ok = in.received[in.contiguous] {
+				delete(in.received, in.contiguous)
+				in.contiguous += length
+			}
+		}
+	case msg.TransferEnd:
+		if in.done {
+			break
+		}
+		if t.Size > opts.MaxSize || t.Size < in.contiguous {
+			err = errors.New("HandleTransfer : bad size of transfer " + in.ID)
+			break
+		}
+		for offset, length := range in.received {
+			if offset+length > t.Size {
+				err = errors.New("HandleTransfer : chunk beyond the size of transfer " + in.ID)
+			}
+		}
+		in.end = &t
+	}
+
+	var reply *msg.Transfer
+	completed := false
+	switch {
+	case err != nil:
+		in.remove()
+		reply = msg.NewTransfer(in.ID, msg.TransferAbort)
+		reply.Reason = err.Error()
+	case in.done:
+		reply = msg.NewTransfer(in.ID, msg.TransferDone)
+	case in.end != nil && in.contiguous == in.end.Size:
+		if err = in.verify(); err == nil {
+			completed = true
+			reply = msg.NewTransfer(in.ID, msg.TransferDone)
+		} else {
+			reply = msg.NewTransfer(in.ID, msg.TransferAbort)
+			reply.Reason = err.Error()
+		}
+	default:
+		reply = msg.NewTransfer(in.ID, msg.TransferAck)
+		reply.Offset = in.contiguous
+	}
+	in.m.Unlock()
+	c.WriteMessage(*reply)
+
+	switch {
+	case completed:
+		transfers.m.Lock()
+		onComplete := transfers.onComplete
+		transfers.m.Unlock()
+		if onComplete != nil {
+			go onComplete(in)
+		} else {
+			os.Remove(in.file.Name()) // nobody reads it
+		}
+		time.AfterFunc(opts.IdleTimeout, func() { // keep answering a sender which missed the done
+			transfers.m.Lock()
+			delete(transfers.in, in.ID)
+			transfers.m.Unlock()
+		})
+	case err != nil:
+		transfers.m.Lock()
+		delete(transfers.in, in.ID)
+		transfers.m.Unlock()
+	}
+	return err
+}
+
+// incoming : transfer a message belongs to, created by its start
+func (t *transfers) incoming(c *ShosetConn, message msg.Transfer) (*IncomingTransfer, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	in, ok := t.in[message.GetTransferID()]
+	if ok || message.GetStage() != msg.TransferStart {
+		return in, nil
+	}
+
+	incomplete := 0
+	for id, old := range t.in { // forget the transfers abandoned by their sender
+		old.m.Lock()
+		idle := time.Since(old.lastSeen) > t.opts.IdleTimeout
+		done := old.done
+		old.m.Unlock()
+		if idle {
+			delete(t.in, id)
+			old.discard()
+		} else if !done {
+			incomplete++
+		}
+	}
+	if incomplete >= t.opts.MaxIncoming {
+		return nil, errors.New("HandleTransfer : too many incoming transfers")
+	}
+
+	file, err := ioutil.TempFile("", "shoset_transfer_")
+	if err != nil {
+		return nil, err
+	}
+	in = &IncomingTransfer{
+		ID:          message.GetTransferID(),
+		Name:        message.Name,
+		ContentType: message.ContentType,
+		From:        c,
+		file:        file,
+		received:    make(map[int64]int64),
+		lastSeen:    time.Now(),
+	}
+	t.in[in.ID] = in
+	return in, nil
+}
+
+// verify : check the digest of a transfer received without gap, its data is
+// removed when it does not match (transfer lock held)
+func (t *IncomingTransfer) verify() error {
+	digest := sha256.New()
+	_, err := t.file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(digest, t.file)
+	}
+	if err == nil && hex.EncodeToString(digest.Sum(nil)) != t.end.Digest {
+		err = errors.New("HandleTransfer : digest mismatch for transfer " + t.ID)
+	}
+	if err != nil {
+		t.remove()
+		return err
+	}
+	t.file.Close()
+	t.Size = t.end.Size
+	t.done = true
+	return nil
+}
+
+// discard : remove the data of an incomplete transfer
+func (t *IncomingTransfer) discard() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if !t.done {
+		t.remove()
+	}
+}
+
+// remove : remove the temporary file of the transfer (transfer lock held)
+func (t *IncomingTransfer) remove() {
+	t.file.Close()
+	os.Remove(t.file.Name())
+}
@@ -0,0 +1,125 @@
+package shoset_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ditrit/shoset"
+	"github.com/ditrit/shoset/msg"
+)
+
+// transferData : data of several chunks
+func transferData() []byte {
+	data := make([]byte, 3*shoset.DefaultTransferOptions.ChunkSize+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// receiveTransfer : data of the next transfer completely received by s
+func receiveTransfer(s *shoset.Shoset) chan []byte {
+	received := make(chan []byte, 1)
+	s.OnTransfer(func(in *shoset.IncomingTransfer) {
+		r, err := in.Reader()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		data, _ := ioutil.ReadAll(r)
+		received <- data
+	})
+	return received
+}
+
+// checkTransfer : send data from conn and check it is received
+func checkTransfer(t *testing.T, from *shoset.Shoset, conn *shoset.ShosetConn, received chan []byte, data []byte) {
+	if err := from.SendPayload(conn, "name", "application/octet-stream", data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes received instead of %d", len(got), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer not received")
+	}
+}
+
+// TestTransfer : a payload is sent in chunks and reassembled, a too large one is aborted
+func TestTransfer(t *testing.T) {
+	cl, aga := newShosets(t)
+	received := receiveTransfer(cl)
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // connected
+	checkTransfer(t, aga, conn, received, transferData())
+
+	opts := shoset.DefaultTransferOptions
+	opts.MaxSize = int64(opts.ChunkSize)
+	cl.SetTransferOptions(opts)
+	if err := aga.SendPayload(conn, "name", "", transferData()); err == nil {
+		t.Error("transfer over MaxSize not aborted")
+	}
+}
+
+// TestTransferResume : a lost chunk is sent again when the transfer resumes
+func TestTransferResume(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultTransferOptions
+	opts.AckTimeout = time.Second
+	aga.SetTransferOptions(opts)
+	received := receiveTransfer(cl)
+	var lost int32
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if chunk, ok := m.(msg.Transfer); ok && chunk.GetStage() == msg.TransferChunk && chunk.Offset > 0 && atomic.CompareAndSwapInt32(&lost, 0, 1) {
+				return nil
+			}
+			return next(c, m)
+		}
+	})
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // connected
+	checkTransfer(t, aga, conn, received, transferData())
+	if atomic.LoadInt32(&lost) == 0 {
+		t.Error("no chunk lost")
+	}
+}
+
+// TestTransferChecksum : a corrupted chunk is ignored and sent again, corrupted data fails the digest
+func TestTransferChecksum(t *testing.T) {
+	cl, aga := newShosets(t)
+	opts := shoset.DefaultTransferOptions
+	opts.AckTimeout = time.Second
+	aga.SetTransferOptions(opts)
+	received := receiveTransfer(cl)
+	var corrupted, resum int32 // the corrupted chunk keeps its checksum unless resum
+	aga.UseOutbound(func(next shoset.Handler) shoset.Handler {
+		return func(c *shoset.ShosetConn, m msg.Message) error {
+			if chunk, ok := m.(msg.Transfer); ok && chunk.GetStage() == msg.TransferChunk && chunk.Offset == 0 && atomic.CompareAndSwapInt32(&corrupted, 0, 1) {
+				data := append([]byte{}, chunk.Data...)
+				data[0]++
+				if atomic.LoadInt32(&resum) == 0 {
+					chunk.Data = data
+				} else {
+					chunk = *msg.NewTransferChunk(chunk.GetTransferID(), chunk.Offset, data)
+				}
+				m = chunk
+			}
+			return next(c, m)
+		}
+	})
+	conn := link(t, aga, cl)
+	time.Sleep(500 * time.Millisecond) // connected
+	checkTransfer(t, aga, conn, received, transferData())
+
+	atomic.StoreInt32(&resum, 1)
+	atomic.StoreInt32(&corrupted, 0)
+	if err := aga.SendPayload(conn, "name", "", transferData()); err == nil {
+		t.Error("transfer with a digest mismatch not aborted")
+	}
+}
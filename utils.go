@@ -10,6 +10,11 @@ import (
 
 // GetIP :
 func GetIP(address string) (string, error) {
+	return getIP(address, 1)
+}
+
+// getIP : address with the ipv4 address of its host, its port must not be below minPort
+func getIP(address string, minPort int) (string, error) {
 	parts := strings.Split(address, ":")
 	if len(parts) != 2 {
 		return "", errors.New("address '" + address + "should respect the format hots_name_or_ip:port")
@@ -22,7 +27,7 @@ func GetIP(address string) (string, error) {
 	if err != nil {
 		return "", errors.New("'" + parts[1] + "' is not a port number")
 	}
-	if port < 1 || port > 65535 {
+	if port < minPort || port > 65535 {
 		return "", errors.New("'" + parts[1] + "' is not a valid port number")
 	}
 	host := getV4(hostIps)